@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// adminReport collects what a maintenance command did (or would do with
+// --dry-run) and prints one line per affected item plus a summary.
+type adminReport struct {
+	command string
+	dryRun  bool
+	counts  map[string]int
+	order   []string
+}
+
+func newAdminReport(command string, dryRun bool) *adminReport {
+	return &adminReport{command: command, dryRun: dryRun, counts: make(map[string]int)}
+}
+
+func (r *adminReport) add(counter, format string, args ...any) {
+	if _, ok := r.counts[counter]; !ok {
+		r.order = append(r.order, counter)
+	}
+	r.counts[counter]++
+	if format != "" {
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+func (r *adminReport) set(counter string, n int) {
+	if _, ok := r.counts[counter]; !ok {
+		r.order = append(r.order, counter)
+	}
+	r.counts[counter] = n
+}
+
+func (r *adminReport) print() {
+	mode := ""
+	if r.dryRun {
+		mode = " (dry run, nothing changed)"
+	}
+	fmt.Printf("\n%s summary%s:\n", r.command, mode)
+	if len(r.order) == 0 {
+		fmt.Println("  nothing to do")
+	}
+	for _, counter := range r.order {
+		fmt.Printf("  %-20s %d\n", counter, r.counts[counter])
+	}
+}
+
+// runReconcile compares the bucket with the Upload table and reports objects
+// without rows and rows without objects, optionally cleaning up both.
+func runReconcile(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report without changing anything")
+	deleteOrphans := fs.Bool("delete-orphans", false, "delete objects that no upload row references")
+	markBroken := fs.Bool("mark-broken", false, "mark rows whose object is missing so their links return 404")
+	minAge := fs.Duration("min-age", time.Hour, "ignore objects modified more recently than this")
+	fs.Parse(args)
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	s3Client := initS3()
+	redisClient := initRedis()
+
+	result, err := reconcile(s3Client, redisClient, ReconcileOptions{
+		DeleteOrphans: *deleteOrphans,
+		MarkBroken:    *markBroken,
+		MinAge:        *minAge,
+		DryRun:        *dryRun,
+	})
+	if err != nil {
+		return err
+	}
+
+	report := newAdminReport("reconcile", *dryRun)
+	report.set("objects scanned", result.ObjectsScanned)
+	report.set("rows scanned", result.RowsScanned)
+
+	for _, obj := range result.OrphanObjects {
+		report.add("orphan objects", "orphan   %s (%s, modified %s)", obj.Key, formatBytes(uint64(obj.Size)), obj.LastModified.Format(time.RFC3339))
+	}
+	for _, upload := range result.BrokenRows {
+		report.add("broken shares", "broken   %s (upload %d, user %s)", upload.FileKey, upload.ID, upload.UserID)
+	}
+	for _, upload := range result.RestoredRows {
+		report.add("restored shares", "restored %s (upload %d)", upload.FileKey, upload.ID)
+	}
+	for _, err := range result.Errors {
+		report.add("errors", "error    %v", err)
+	}
+	if result.DeletedObjects > 0 {
+		report.set("objects deleted", result.DeletedObjects)
+	}
+	if result.MarkedRows > 0 {
+		report.set("rows marked", result.MarkedRows)
+	}
+
+	report.print()
+	return nil
+}
+
+// runPurge permanently removes soft-deleted uploads and their objects.
+func runPurge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report without changing anything")
+	olderThan := fs.Duration("older-than", 0, "only purge rows deleted at least this long ago")
+	fs.Parse(args)
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	s3Client := initS3()
+
+	var uploads []Upload
+	if err := DB.Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", time.Now().Add(-*olderThan)).
+		Order("id").Find(&uploads).Error; err != nil {
+		return fmt.Errorf("Failed to query deleted uploads: %w", err)
+	}
+
+	report := newAdminReport("purge", *dryRun)
+	var freed int64
+	for _, upload := range uploads {
+		report.add("purged", "purge    %s (upload %d, %s)", upload.FileKey, upload.ID, formatBytes(uint64(upload.FileSize)))
+		if *dryRun {
+			freed += upload.FileSize
+			continue
+		}
+
+		if err := s3Client.deleteObject(upload.FileKey); err != nil {
+			report.add("errors", "error    deleting object %s: %v", upload.FileKey, err)
+			continue
+		}
+		// A preview left behind is an orphan the reconciler can clean up.
+		for _, key := range []string{upload.ThumbnailKey, upload.StoryboardKey} {
+			if key != "" {
+				s3Client.deleteObject(key)
+			}
+		}
+		if err := DB.Unscoped().Delete(&upload).Error; err != nil {
+			report.add("errors", "error    deleting row %d: %v", upload.ID, err)
+			continue
+		}
+		freed += upload.FileSize
+	}
+
+	report.print()
+	fmt.Printf("  %-20s %s\n", "storage freed", formatBytes(uint64(freed)))
+
+	appLogger.WithFields(logrus.Fields{"count": len(uploads), "dry_run": *dryRun}).Info("Purge completed")
+	return nil
+}
+
+// runRecompute re-reads stored objects and corrects recorded sizes and checksums.
+func runRecompute(args []string) error {
+	fs := flag.NewFlagSet("recompute", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report without changing anything")
+	missingOnly := fs.Bool("missing-only", false, "only rows without a checksum")
+	fs.Parse(args)
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	s3Client := initS3()
+	redisClient := initRedis()
+
+	query := DB.Order("id")
+	if *missingOnly {
+		query = query.Where("checksum IS NULL OR checksum = ''")
+	}
+
+	report := newAdminReport("recompute", *dryRun)
+	var uploads []Upload
+	err := query.FindInBatches(&uploads, 100, func(tx *gorm.DB, batch int) error {
+		for _, upload := range uploads {
+			report.add("checked", "")
+
+			size, checksum, err := objectChecksum(s3Client, upload.FileKey)
+			if err != nil {
+				report.add("errors", "error    %s: %v", upload.FileKey, err)
+				continue
+			}
+
+			if size == upload.FileSize && checksum == upload.Checksum {
+				continue
+			}
+
+			report.add("updated", "update   %s: size %d -> %d, checksum %q -> %q", upload.FileKey, upload.FileSize, size, upload.Checksum, checksum)
+			if *dryRun {
+				continue
+			}
+
+			if err := DB.Model(&upload).Updates(map[string]any{"file_size": size, "checksum": checksum}).Error; err != nil {
+				report.add("errors", "error    updating row %d: %v", upload.ID, err)
+				continue
+			}
+			redisClient.deleteShareCache(upload.UserID)
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return fmt.Errorf("Failed to scan uploads: %w", err)
+	}
+
+	report.print()
+	return nil
+}
+
+func objectChecksum(s3Client *S3Client, fileKey string) (int64, string, error) {
+	stream, err := s3Client.getFileStream(fileKey)
+	if err != nil {
+		return 0, "", err
+	}
+	defer stream.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, stream)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read object: %w", err)
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// runFlushCache drops cached /my-shares listings for one user or for everyone.
+func runFlushCache(args []string) error {
+	fs := flag.NewFlagSet("flush-cache", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report without changing anything")
+	userID := fs.String("user", "", "only flush this user's cache")
+	fs.Parse(args)
+
+	redisClient := initRedis()
+
+	report := newAdminReport("flush-cache", *dryRun)
+	var keys []string
+	var err error
+	if *userID != "" {
+		// Looked up as is rather than scanned for, so a user ID with glob
+		// characters such as * can't match other users' keys.
+		keys, err = redisClient.existingKeys(fmt.Sprintf("user:shares:%s", *userID))
+	} else {
+		keys, err = redisClient.scanKeys("user:shares:*")
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		report.add("flushed", "flush    %s", key)
+	}
+	if !*dryRun && len(keys) > 0 {
+		if err := redisClient.deleteKeys(keys); err != nil {
+			return err
+		}
+	}
+
+	report.print()
+	return nil
+}
+
+// runReassign moves every upload owned by one user ID to another.
+func runReassign(args []string) error {
+	fs := flag.NewFlagSet("reassign", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report without changing anything")
+	from := fs.String("from", "", "user ID that currently owns the uploads")
+	to := fs.String("to", "", "user ID to move the uploads to")
+	fs.Parse(args)
+
+	if *from == "" || *to == "" {
+		return fmt.Errorf("both --from and --to are required")
+	}
+	if *from == *to {
+		return fmt.Errorf("--from and --to are the same user")
+	}
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	redisClient := initRedis()
+
+	var uploads []Upload
+	if err := DB.Where("user_id = ?", *from).Order("id").Find(&uploads).Error; err != nil {
+		return fmt.Errorf("Failed to query uploads: %w", err)
+	}
+
+	report := newAdminReport("reassign", *dryRun)
+	for _, upload := range uploads {
+		report.add("reassigned", "move     %s (upload %d)", upload.Filename, upload.ID)
+	}
+
+	if !*dryRun && len(uploads) > 0 {
+		if err := DB.Model(&Upload{}).Where("user_id = ?", *from).Update("user_id", *to).Error; err != nil {
+			return fmt.Errorf("Failed to reassign uploads: %w", err)
+		}
+		redisClient.deleteShareCache(*from)
+		redisClient.deleteShareCache(*to)
+	}
+
+	report.print()
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"mime/multipart"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// AnimationFormat is what /compress-media turns animated GIFs into.
+type AnimationFormat string
+
+const (
+	// AnimationGIF keeps animated GIFs as GIFs, made smaller by
+	// compressAnimatedGIF.
+	AnimationGIF  AnimationFormat = "gif"
+	AnimationMP4  AnimationFormat = "mp4"
+	AnimationWebM AnimationFormat = "webm"
+)
+
+// parseAnimationFormat parses the "animation" form value; empty means gif.
+func parseAnimationFormat(value string) (AnimationFormat, error) {
+	switch format := AnimationFormat(strings.ToLower(strings.TrimSpace(value))); format {
+	case "":
+		return AnimationGIF, nil
+	case AnimationGIF, AnimationMP4, AnimationWebM:
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid animation %q: use gif, mp4 or webm", value)
+}
+
+// gifSettings are how animated GIFs are made smaller at each quality: the
+// size their frames are scaled down to fit, how many colors they share, and
+// every how many frames one is kept. Dropped frames add their delay to the
+// frame before them, so the animation keeps its speed.
+var gifSettings = map[CompressionQuality]struct {
+	maxDimension int
+	colors       int
+	frameStep    int
+}{
+	QualityHigh:   {maxDimension: 800, colors: 256, frameStep: 1},
+	QualityMedium: {maxDimension: 480, colors: 128, frameStep: 2},
+	QualityLow:    {maxDimension: 320, colors: 64, frameStep: 3},
+}
+
+// maxAnimatedGIFPixels caps the canvas size times the frame count of the
+// animated GIFs compressAnimatedGIF takes on, as every frame is decoded and
+// played back on a canvas of that size.
+const maxAnimatedGIFPixels = 100 << 20
+
+var errNotGIF = errors.New("not a GIF")
+
+// isAnimatedGIF reports whether file is a GIF with more than one frame.
+func isAnimatedGIF(file *multipart.FileHeader) bool {
+	src, err := file.Open()
+	if err != nil {
+		return false
+	}
+	defer src.Close()
+
+	_, frames, err := scanGIF(src)
+	return err == nil && frames > 1
+}
+
+// scanGIF returns the screen size and frame count of the GIF read from r. It
+// only walks the block structure, skipping over the image data, so it is
+// cheap however large the frames are.
+func scanGIF(r io.Reader) (image.Config, int, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return image.Config{}, 0, errNotGIF
+	}
+	if string(header[:6]) != "GIF87a" && string(header[:6]) != "GIF89a" {
+		return image.Config{}, 0, errNotGIF
+	}
+	config := image.Config{
+		Width:  int(header[6]) | int(header[7])<<8,
+		Height: int(header[8]) | int(header[9])<<8,
+	}
+	if header[10]&0x80 != 0 {
+		if _, err := br.Discard(3 << (header[10]&7 + 1)); err != nil {
+			return config, 0, fmt.Errorf("GIF is truncated: %w", err)
+		}
+	}
+
+	frames := 0
+	for {
+		block, err := br.ReadByte()
+		if err != nil {
+			return config, frames, fmt.Errorf("GIF is truncated: %w", err)
+		}
+		switch block {
+		case 0x21: // extension: label, then data sub-blocks
+			if _, err := br.ReadByte(); err != nil {
+				return config, frames, fmt.Errorf("GIF is truncated: %w", err)
+			}
+		case 0x2c: // image descriptor, local color table, LZW code size
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(br, descriptor); err != nil {
+				return config, frames, fmt.Errorf("GIF is truncated: %w", err)
+			}
+			skip := 1
+			if descriptor[8]&0x80 != 0 {
+				skip += 3 << (descriptor[8]&7 + 1)
+			}
+			if _, err := br.Discard(skip); err != nil {
+				return config, frames, fmt.Errorf("GIF is truncated: %w", err)
+			}
+			frames++
+		case 0x3b: // trailer
+			return config, frames, nil
+		default:
+			return config, frames, fmt.Errorf("GIF has unknown block 0x%02x", block)
+		}
+		if err := skipSubBlocks(br); err != nil {
+			return config, frames, fmt.Errorf("GIF is truncated: %w", err)
+		}
+	}
+}
+
+// skipSubBlocks skips a run of GIF data sub-blocks and its terminator.
+func skipSubBlocks(br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := br.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// compressAnimatedGIF writes a smaller copy of g to w, scaled, thinned out and
+// reduced to one palette according to quality. The palette is picked from
+// every frame and applied without dithering, so still areas don't flicker, and
+// GIFs without transparency only store the pixels that change between frames.
+func compressAnimatedGIF(w io.Writer, g *gif.GIF, quality CompressionQuality) error {
+	settings := gifSettings[quality]
+	frames := composeFrames(g, settings.maxDimension, settings.frameStep)
+	if len(frames) == 0 {
+		return fmt.Errorf("GIF has no frames")
+	}
+
+	// Index 0 is kept for transparency: real transparency if the GIF has any,
+	// otherwise pixels unchanged since the last frame. GIFs have no partial
+	// transparency, so pixels are either transparent or opaque.
+	transparent := false
+	limit := max(maxQuantizeSamples/len(frames), 1)
+	var samples colorBox
+	for _, frame := range frames {
+		for i := 3; i < len(frame.img.Pix); i += 4 {
+			if frame.img.Pix[i] < 0x80 {
+				transparent = true
+				break
+			}
+		}
+		for _, c := range sampleColors(frame.img, limit) {
+			if c.A >= 0x80 {
+				c.A = 0xff
+				samples = append(samples, c)
+			}
+		}
+	}
+	palette := append(color.Palette{color.NRGBA{}}, medianCut(samples, settings.colors-1)...)
+	lookup := newPaletteLookup(palette)
+
+	bounds := frames[0].img.Bounds()
+	out := &gif.GIF{
+		LoopCount: g.LoopCount,
+		Config:    image.Config{ColorModel: palette, Width: bounds.Dx(), Height: bounds.Dy()},
+	}
+	var previous *image.Paletted
+	for _, frame := range frames {
+		paletted := image.NewPaletted(bounds, palette)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := frame.img.NRGBAAt(x, y)
+				if c.A < 0x80 {
+					continue // index 0
+				}
+				index := lookup.index(c)
+				if previous != nil && previous.ColorIndexAt(x, y) == index {
+					continue // shows through from the last frame
+				}
+				paletted.SetColorIndex(x, y, index)
+			}
+		}
+
+		disposal := byte(gif.DisposalNone)
+		if transparent {
+			// Transparent pixels have to show what's behind the GIF, not the
+			// last frame, so each frame is cleared before the next.
+			disposal = gif.DisposalBackground
+		} else if previous == nil {
+			previous = paletted
+		} else {
+			previous = fillUnchanged(paletted, previous)
+		}
+
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, frame.delay)
+		out.Disposal = append(out.Disposal, disposal)
+	}
+
+	return gif.EncodeAll(w, out)
+}
+
+// fillUnchanged returns what is on screen after frame is drawn over shown, the
+// screen before it: frame with its transparent pixels taken from shown.
+func fillUnchanged(frame, shown *image.Paletted) *image.Paletted {
+	screen := image.NewPaletted(frame.Rect, frame.Palette)
+	for i, index := range frame.Pix {
+		if index == 0 {
+			index = shown.Pix[i]
+		}
+		screen.Pix[i] = index
+	}
+	return screen
+}
+
+// gifFrame is one frame of an animation as it appears on screen.
+type gifFrame struct {
+	img   *image.NRGBA
+	delay int
+}
+
+// composeFrames plays g back, applying each frame's disposal, and returns
+// every step-th frame as shown, scaled down to fit maxDimension.
+func composeFrames(g *gif.GIF, maxDimension, step int) []gifFrame {
+	canvasBounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if canvasBounds.Empty() {
+		for _, frame := range g.Image {
+			canvasBounds = canvasBounds.Union(frame.Bounds())
+		}
+	}
+	canvas := image.NewNRGBA(canvasBounds)
+
+	var frames []gifFrame
+	for i, frame := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var saved *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			saved = imaging.Clone(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		if i%step == 0 {
+			delay := 0
+			for j := i; j < i+step && j < len(g.Delay); j++ {
+				delay += g.Delay[j]
+			}
+			shown := imaging.Clone(canvas)
+			if shown.Bounds().Dx() > maxDimension || shown.Bounds().Dy() > maxDimension {
+				shown = imaging.Fit(shown, maxDimension, maxDimension, imaging.Lanczos)
+			}
+			frames = append(frames, gifFrame{img: shown, delay: delay})
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = saved
+		}
+	}
+	return frames
+}
+
+// paletteLookup maps colors to their nearest opaque palette entry, caching
+// the answer for each color at 5 bits per channel, as animations repeat the
+// same colors frame after frame.
+type paletteLookup struct {
+	palette color.Palette
+	cache   []int16
+}
+
+func newPaletteLookup(palette color.Palette) *paletteLookup {
+	cache := make([]int16, 1<<15)
+	for i := range cache {
+		cache[i] = -1
+	}
+	return &paletteLookup{palette: palette, cache: cache}
+}
+
+func (l *paletteLookup) index(c color.NRGBA) uint8 {
+	key := int(c.R>>3)<<10 | int(c.G>>3)<<5 | int(c.B>>3)
+	if cached := l.cache[key]; cached >= 0 {
+		return uint8(cached)
+	}
+
+	// Index 0 is transparent and never a match.
+	best, bestDistance := 1, -1
+	for i := 1; i < len(l.palette); i++ {
+		p := l.palette[i].(color.NRGBA)
+		dr, dg, db := int(c.R)-int(p.R), int(c.G)-int(p.G), int(c.B)-int(p.B)
+		if distance := dr*dr + dg*dg + db*db; bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+	l.cache[key] = int16(best)
+	return uint8(best)
+}
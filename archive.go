@@ -0,0 +1,395 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// storedExtensions are formats that are already compressed, so deflating them
+// again only costs CPU. They are stored in zips as-is.
+var storedExtensions = map[string]bool{
+	".7z": true, ".aac": true, ".avi": true, ".avif": true, ".br": true, ".bz2": true,
+	".docx": true, ".flac": true, ".gif": true, ".gz": true, ".heic": true, ".jar": true,
+	".jpeg": true, ".jpg": true, ".m4a": true, ".m4v": true, ".mkv": true, ".mov": true,
+	".mp3": true, ".mp4": true, ".odt": true, ".ogg": true, ".opus": true, ".png": true,
+	".pptx": true, ".rar": true, ".tgz": true, ".webm": true, ".webp": true, ".xlsx": true,
+	".xz": true, ".zip": true, ".zst": true,
+}
+
+// zipMethod picks Store for already-compressed formats and Deflate otherwise.
+func zipMethod(filename string) uint16 {
+	if storedExtensions[strings.ToLower(path.Ext(filename))] {
+		return zip.Store
+	}
+	return zip.Deflate
+}
+
+// uniqueNames suffixes repeated archive paths with " (2)", " (3)" and so on,
+// compared case-insensitively since most filesystems extract them that way.
+func uniqueNames(names []string) []string {
+	unique := make([]string, len(names))
+	used := make(map[string]bool)
+	for i, name := range names {
+		dir, file := path.Split(name)
+		ext := path.Ext(file)
+		base := strings.TrimSuffix(file, ext)
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s%s (%d)%s", dir, base, n, ext)
+		}
+		used[strings.ToLower(name)] = true
+		unique[i] = name
+	}
+	return unique
+}
+
+// archivePath cleans a client-supplied relative path for use inside an
+// archive. Empty, "." and ".." segments and drive letters are dropped, so no
+// entry can point outside the directory it is extracted into.
+func archivePath(name, fallback string) string {
+	var parts []string
+	for _, part := range strings.Split(strings.ReplaceAll(name, "\\", "/"), "/") {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		if len(parts) == 0 && len(part) == 2 && part[1] == ':' {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return fallback
+	}
+	return strings.Join(parts, "/")
+}
+
+// writeZip writes uploads to w as a zip archive. Only one object is open at a
+// time and nothing is buffered beyond the copy buffer, so archives of any size
+// stream in constant memory. archive/zip switches to ZIP64 records once sizes
+// or offsets pass 4 GiB.
+func (s *S3Client) writeZip(w io.Writer, uploads []Upload) error {
+	return createArchive(w, s.uploadEntries(uploads), ArchiveOptions{Format: "zip", Compression: "auto"})
+}
+
+// uploadEntries turns stored uploads into archive entries read from storage,
+// each under its own filename.
+func (s *S3Client) uploadEntries(uploads []Upload) []archiveEntry {
+	entries := make([]archiveEntry, len(uploads))
+	for i, upload := range uploads {
+		entries[i] = archiveEntry{
+			archiveHeader: archiveHeader{
+				Name:     path.Base(archivePath(upload.Filename, "file")),
+				Size:     upload.FileSize,
+				Mode:     defaultFileMode,
+				Modified: upload.UploadedAt,
+			},
+			open: func() (io.ReadCloser, error) {
+				return s.getFileStream(upload.FileKey)
+			},
+		}
+	}
+	return entries
+}
+
+// streamZip answers ctx with uploads zipped on the fly. The response is chunked
+// because the archive size isn't known up front; if a file fails halfway the
+// connection is cut, which clients see as a truncated download.
+func (s *S3Client) streamZip(ctx *fiber.Ctx, filename string, uploads []Upload) error {
+	ctx.Set(fiber.HeaderContentType, "application/zip")
+	ctx.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"%s\"", filename))
+
+	fields := logrus.Fields{"archive": filename, "file_count": len(uploads)}
+	entry := logWithFields(ctx, fields)
+
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		start := time.Now()
+		if err := s.writeZip(w, uploads); err != nil {
+			entry.WithError(err).Error("Zip download failed")
+			return
+		}
+		if err := w.Flush(); err != nil {
+			entry.WithError(err).Debug("Client disconnected during zip download")
+			return
+		}
+		entry.WithField("duration_ms", time.Since(start).Milliseconds()).Info("Zip download completed")
+	})
+	return nil
+}
+
+// availableUploads drops uploads whose objects have gone missing from storage.
+func availableUploads(uploads []Upload) []Upload {
+	available := make([]Upload, 0, len(uploads))
+	for _, upload := range uploads {
+		if upload.MissingAt == nil {
+			available = append(available, upload)
+		}
+	}
+	return available
+}
+
+// loadUploads loads the committed uploads with uploadIDs in the order given.
+func loadUploads(uploadIDs []uint) ([]Upload, error) {
+	var found []Upload
+	if err := DB.Scopes(committedUploads).Where("id IN ?", uploadIDs).Find(&found).Error; err != nil {
+		return nil, err
+	}
+
+	byID := make(map[uint]Upload, len(found))
+	for _, upload := range found {
+		byID[upload.ID] = upload
+	}
+	uploads := make([]Upload, 0, len(found))
+	for _, id := range uploadIDs {
+		if upload, ok := byID[id]; ok {
+			uploads = append(uploads, upload)
+		}
+	}
+	return uploads, nil
+}
+
+// archiveFilename makes an archive name ending in ext from a title, falling
+// back to fallback.
+func archiveFilename(title, fallback, ext string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < 32 {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(title))
+	if name == "" {
+		name = fallback
+	}
+	if strings.HasSuffix(strings.ToLower(name), ext) {
+		return name
+	}
+	return name + ext
+}
+
+// manifestName is the checksum manifest added to archives that ask for one. It
+// uses the sha256sum format, so `sha256sum -c SHA256SUMS` verifies the files.
+const manifestName = "SHA256SUMS"
+
+// maxZipComment is the longest comment the zip format can hold.
+const maxZipComment = 65535
+
+// ArchiveOptions are the per-archive settings accepted by /create-zip.
+type ArchiveOptions struct {
+	Name        string
+	Format      string // a key of archiveFormats
+	Compression string // "auto", "store", "fast" or "best"
+	Comment     string
+	Manifest    bool
+	// Password encrypts zip entries with WinZip AES-256. It is only held
+	// while the archive is written.
+	Password string
+	// SplitSize, when set, stores the archive as parts of at most this many
+	// bytes instead of one upload.
+	SplitSize int64
+	// StripMetadata runs every file through stripMetadata on its way in.
+	StripMetadata bool
+}
+
+// compressionLevels maps the compression choices to flate levels.
+var compressionLevels = map[string]int{
+	"auto": flate.DefaultCompression,
+	"fast": flate.BestSpeed,
+	"best": flate.BestCompression,
+}
+
+// archiveOptionsFromForm reads "format", "archive_name", "compression",
+// "comment", "manifest", "archive_password" and "split" from the request.
+func archiveOptionsFromForm(ctx *fiber.Ctx) (ArchiveOptions, error) {
+	opts := ArchiveOptions{
+		Format:      strings.ToLower(strings.TrimSpace(ctx.FormValue("format"))),
+		Compression: strings.ToLower(strings.TrimSpace(ctx.FormValue("compression"))),
+		Comment:     ctx.FormValue("comment"),
+		Manifest:    ctx.FormValue("manifest") == "true" || ctx.FormValue("manifest") == "on",
+		Password:    ctx.FormValue("archive_password"),
+	}
+
+	if opts.Format == "" {
+		opts.Format = "zip"
+	}
+	format, ok := archiveFormats[opts.Format]
+	if !ok {
+		return opts, fmt.Errorf("invalid format %q: use zip, tar, tar.gz or tar.zst", opts.Format)
+	}
+	if opts.Compression == "" {
+		opts.Compression = "auto"
+	}
+	if _, ok := compressionLevels[opts.Compression]; !ok && opts.Compression != "store" {
+		return opts, fmt.Errorf("invalid compression %q: use auto, store, fast or best", opts.Compression)
+	}
+	if opts.Comment != "" && opts.Format != "zip" {
+		return opts, fmt.Errorf("archive comments are only supported for zip archives")
+	}
+	if opts.Password != "" && opts.Format != "zip" {
+		return opts, fmt.Errorf("password encryption is only supported for zip archives")
+	}
+	if len(opts.Comment) > maxZipComment {
+		return opts, fmt.Errorf("archive comment is too long: at most %d bytes", maxZipComment)
+	}
+	splitSize, err := parseSplitSize(ctx.FormValue("split"))
+	if err != nil {
+		return opts, err
+	}
+	opts.SplitSize = splitSize
+
+	opts.Name = archiveFilename(ctx.FormValue("archive_name"), fmt.Sprintf("archive_%d", time.Now().Unix()), format.Ext)
+	return opts, nil
+}
+
+// archiveEntry is one file headed into an archive. open is called when the
+// file is about to be written and the result closed right after.
+type archiveEntry struct {
+	archiveHeader
+	open func() (io.ReadCloser, error)
+}
+
+// formEntries names each file uploaded with the request inside the archive.
+// paths, when given, holds each file's relative path (webkitRelativePath for
+// directory uploads) in the same order as files; otherwise files go in flat
+// under their names. modes likewise holds octal permissions such as "755";
+// files without one get defaultFileMode.
+func formEntries(files []*multipart.FileHeader, paths, modes []string) ([]archiveEntry, error) {
+	if len(paths) > 0 && len(paths) != len(files) {
+		return nil, fmt.Errorf("got %d paths for %d files", len(paths), len(files))
+	}
+	if len(modes) > 0 && len(modes) != len(files) {
+		return nil, fmt.Errorf("got %d modes for %d files", len(modes), len(files))
+	}
+
+	names := make([]string, len(files))
+	for i, file := range files {
+		name := file.Filename
+		if len(paths) > 0 && strings.TrimSpace(paths[i]) != "" {
+			name = paths[i]
+		}
+		names[i] = archivePath(name, path.Base(archivePath(file.Filename, "file")))
+	}
+
+	now := time.Now()
+	entries := make([]archiveEntry, len(files))
+	for i, name := range names {
+		file := files[i]
+		mode := defaultFileMode
+		if len(modes) > 0 && strings.TrimSpace(modes[i]) != "" {
+			perm, err := strconv.ParseUint(strings.TrimSpace(modes[i]), 8, 32)
+			if err != nil || perm > 0o777 {
+				return nil, fmt.Errorf("invalid mode %q for %s", modes[i], name)
+			}
+			mode = fs.FileMode(perm)
+		}
+
+		entries[i] = archiveEntry{
+			archiveHeader: archiveHeader{Name: name, Size: file.Size, Mode: mode, Modified: now},
+			open: func() (io.ReadCloser, error) {
+				return file.Open()
+			},
+		}
+	}
+	return entries, nil
+}
+
+// createArchive writes entries to w as an archive in opts.Format, renaming
+// entries whose names clash. Each file is opened, copied and closed before the
+// next, so only one input is open at a time.
+func createArchive(w io.Writer, entries []archiveEntry, opts ArchiveOptions) error {
+	start := time.Now()
+	appLogger.WithFields(logrus.Fields{"file_count": len(entries), "format": opts.Format}).Info("Creating archive")
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name
+	}
+	for i, name := range uniqueNames(names) {
+		entries[i].Name = name
+	}
+
+	archive, err := newArchiveWriter(w, opts)
+	if err != nil {
+		return err
+	}
+
+	var manifest strings.Builder
+	for _, entry := range entries {
+		checksum, err := addArchiveEntry(archive, entry, opts.StripMetadata)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "%s  %s\n", checksum, entry.Name)
+	}
+
+	if opts.Manifest {
+		name := manifestName
+		for i := 2; hasEntry(entries, name); i++ {
+			name = fmt.Sprintf("%s (%d)", manifestName, i)
+		}
+		hdr := archiveHeader{Name: name, Size: int64(manifest.Len()), Mode: defaultFileMode, Modified: time.Now()}
+		if err := archive.Add(hdr, strings.NewReader(manifest.String())); err != nil {
+			return fmt.Errorf("Failed to add checksum manifest: %w", err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		appLogger.WithError(err).Error("Failed to finalize archive")
+		return fmt.Errorf("Failed to finalize archive: %w", err)
+	}
+
+	appLogger.WithField("duration_ms", time.Since(start).Milliseconds()).Info("Archive created successfully")
+	return nil
+}
+
+// addArchiveEntry copies one file into archive, stripped of its metadata if
+// strip is set, and returns its hex SHA-256.
+func addArchiveEntry(archive archiveWriter, entry archiveEntry, strip bool) (string, error) {
+	fileReader, err := entry.open()
+	if err != nil {
+		appLogger.WithField("filename", entry.Name).WithError(err).Error("Failed to open file for archiving")
+		return "", fmt.Errorf("Failed to open file %s: %w", entry.Name, err)
+	}
+	defer fileReader.Close()
+
+	hdr := entry.archiveHeader
+	var src io.Reader = fileReader
+	if strip {
+		stripped, size, err := stripMetadataReader(entry.Name, fileReader)
+		if err != nil {
+			appLogger.WithField("filename", entry.Name).WithError(err).Error("Failed to strip metadata for archiving")
+			return "", fmt.Errorf("Failed to strip metadata from %s: %w", entry.Name, err)
+		}
+		src = stripped
+		if size >= 0 {
+			hdr.Size = size
+		}
+	}
+
+	hash := sha256.New()
+	if err := archive.Add(hdr, io.TeeReader(src, hash)); err != nil {
+		appLogger.WithField("filename", entry.Name).WithError(err).Error("Failed to add file to archive")
+		return "", fmt.Errorf("Failed to add file %s to archive: %w", entry.Name, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hasEntry(entries []archiveEntry, name string) bool {
+	for _, entry := range entries {
+		if strings.EqualFold(entry.Name, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	"gorm.io/gorm"
+)
+
+const (
+	// maxArchiveEntries caps how many entries of one archive are recorded.
+	maxArchiveEntries = 50000
+	// rangeBlockSize is how much objectReaderAt fetches per request.
+	rangeBlockSize   = 1024 * 1024
+	rangeCacheBlocks = 8
+)
+
+// archiveFormatOf returns the archiveFormats key of filename, or "" when it
+// isn't an archive whose entries can be listed.
+func archiveFormatOf(filename string) string {
+	lower := strings.ToLower(filename)
+	if strings.HasSuffix(lower, ".tgz") {
+		return "tar.gz"
+	}
+	for name, format := range archiveFormats {
+		if strings.HasSuffix(lower, format.Ext) {
+			return name
+		}
+	}
+	return ""
+}
+
+// objectReaderAt reads a stored object through ranged GETs. Whole blocks are
+// fetched and the last few kept, so the many small reads archive parsers make
+// don't each turn into a request. It is not safe for concurrent use.
+type objectReaderAt struct {
+	s      *S3Client
+	key    string
+	size   int64
+	blocks map[int64][]byte
+	order  []int64
+}
+
+func (s *S3Client) newObjectReaderAt(key string, size int64) *objectReaderAt {
+	return &objectReaderAt{s: s, key: key, size: size, blocks: make(map[int64][]byte)}
+}
+
+func (r *objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off < r.size {
+		index := off / rangeBlockSize
+		block, err := r.block(index)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], block[off-index*rangeBlockSize:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *objectReaderAt) block(index int64) ([]byte, error) {
+	if block, ok := r.blocks[index]; ok {
+		return block, nil
+	}
+
+	start := index * rangeBlockSize
+	body, err := r.s.getFileRange(r.key, start, min(rangeBlockSize, r.size-start))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	block, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.order) == rangeCacheBlocks {
+		delete(r.blocks, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.blocks[index] = block
+	r.order = append(r.order, index)
+	return block, nil
+}
+
+// readCloser pairs a reader with whatever has to be closed after it.
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+// openZip reads the central directory of a zip upload with ranged reads.
+func (s *S3Client) openZip(upload Upload) (*zip.Reader, error) {
+	zr, err := zip.NewReader(s.newObjectReaderAt(upload.FileKey, upload.FileSize), upload.FileSize)
+	// Unsafe names are cleaned by archivePath, so they aren't a reason to give up.
+	if errors.Is(err, zip.ErrInsecurePath) {
+		err = nil
+	}
+	return zr, err
+}
+
+// openTar opens a tar upload, decompressing it if needed, for reading from the
+// start. The returned closer releases the object stream.
+func (s *S3Client) openTar(upload Upload, format string) (*tar.Reader, io.Closer, error) {
+	stream, err := s.getFileStream(upload.FileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var r io.Reader = stream
+	closer := &readCloser{close: stream.Close}
+	switch format {
+	case "tar.gz":
+		gz, err := gzip.NewReader(stream)
+		if err != nil {
+			stream.Close()
+			return nil, nil, err
+		}
+		r = gz
+	case "tar.zst":
+		zr, err := zstd.NewReader(stream)
+		if err != nil {
+			stream.Close()
+			return nil, nil, err
+		}
+		r = zr
+		closer.close = func() error {
+			zr.Close()
+			return stream.Close()
+		}
+	}
+	return tar.NewReader(r), closer, nil
+}
+
+// readArchiveEntries lists the regular files in an archive upload.
+func (s *S3Client) readArchiveEntries(upload Upload) ([]ArchiveEntry, error) {
+	switch format := archiveFormatOf(upload.Filename); format {
+	case "zip":
+		zr, err := s.openZip(upload)
+		if err != nil {
+			return nil, err
+		}
+		return zipArchiveEntries(zr), nil
+	case "tar":
+		// A plain tar can be read with seeks, so only the headers are fetched
+		// and each entry's data offset is known.
+		sr := io.NewSectionReader(s.newObjectReaderAt(upload.FileKey, upload.FileSize), 0, upload.FileSize)
+		return tarArchiveEntries(tar.NewReader(sr), sr)
+	case "tar.gz", "tar.zst":
+		tr, closer, err := s.openTar(upload, format)
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+		return tarArchiveEntries(tr, nil)
+	}
+	return nil, fmt.Errorf("%s is not a supported archive", upload.Filename)
+}
+
+func zipArchiveEntries(zr *zip.Reader) []ArchiveEntry {
+	var entries []ArchiveEntry
+	seen := make(map[string]bool)
+	for _, f := range zr.File {
+		name := archivePath(f.Name, "")
+		if !f.Mode().IsRegular() || name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		modified := f.Modified
+		entries = append(entries, ArchiveEntry{
+			Path:      name,
+			Size:      int64(f.UncompressedSize64),
+			Mode:      uint32(f.Mode().Perm()),
+			Modified:  &modified,
+			Encrypted: f.Flags&0x1 != 0,
+		})
+		if len(entries) == maxArchiveEntries {
+			break
+		}
+	}
+	return entries
+}
+
+// tarArchiveEntries reads the regular files from tr. When pos is the seeker tr
+// reads from, each entry's data offset is recorded too.
+func tarArchiveEntries(tr *tar.Reader, pos io.Seeker) ([]ArchiveEntry, error) {
+	var entries []ArchiveEntry
+	seen := make(map[string]bool)
+	for len(entries) < maxArchiveEntries {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := archivePath(hdr.Name, "")
+		if hdr.Typeflag != tar.TypeReg || name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		modified := hdr.ModTime
+		entry := ArchiveEntry{
+			Path:     name,
+			Size:     hdr.Size,
+			Mode:     uint32(hdr.FileInfo().Mode().Perm()),
+			Modified: &modified,
+		}
+		if pos != nil {
+			offset, err := pos.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			entry.DataOffset = &offset
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// archiveIndexing keeps concurrent views of the same archive from indexing it
+// twice: later callers wait for the indexing in progress and share its result.
+var archiveIndexing singleflight.Group
+
+// indexArchive records the entries of an archive upload unless that was done
+// already. Archives that fail to read stay unindexed so the next view retries.
+func (s *S3Client) indexArchive(upload *Upload) error {
+	indexedAt, err, _ := archiveIndexing.Do(strconv.FormatUint(uint64(upload.ID), 10), func() (any, error) {
+		return s.recordArchiveEntries(*upload)
+	})
+	if err != nil {
+		return err
+	}
+	at := indexedAt.(time.Time)
+	upload.EntriesIndexedAt = &at
+	return nil
+}
+
+// recordArchiveEntries does the work of indexArchive and returns when the
+// archive was indexed.
+func (s *S3Client) recordArchiveEntries(upload Upload) (time.Time, error) {
+	var current Upload
+	if err := DB.Select("id", "entries_indexed_at").First(&current, upload.ID).Error; err != nil {
+		return time.Time{}, err
+	}
+	if current.EntriesIndexedAt != nil {
+		return *current.EntriesIndexedAt, nil
+	}
+
+	start := time.Now()
+	entries, err := s.readArchiveEntries(upload)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read archive entries: %w", err)
+	}
+
+	now := time.Now()
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("upload_id = ?", upload.ID).Delete(&ArchiveEntry{}).Error; err != nil {
+			return err
+		}
+		for i := range entries {
+			entries[i].UploadID = upload.ID
+		}
+		if len(entries) > 0 {
+			if err := tx.CreateInBatches(entries, 500).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&Upload{}).Where("id = ?", upload.ID).Update("entries_indexed_at", now).Error
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to save archive entries: %w", err)
+	}
+
+	appLogger.WithFields(logrus.Fields{
+		"upload_id":   upload.ID,
+		"entry_count": len(entries),
+		"duration_ms": time.Since(start).Milliseconds(),
+	}).Info("archive indexed")
+	return now, nil
+}
+
+// archiveEntries returns the entries of an archive upload in path order,
+// indexing it first if needed.
+func (s *S3Client) archiveEntries(upload *Upload) ([]ArchiveEntry, error) {
+	if upload.EntriesIndexedAt == nil {
+		if err := s.indexArchive(upload); err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []ArchiveEntry
+	err := DB.Where("upload_id = ?", upload.ID).Order("path").Find(&entries).Error
+	return entries, err
+}
+
+// findArchiveEntry looks up the entry at entryPath in an archive upload.
+func (s *S3Client) findArchiveEntry(upload *Upload, entryPath string) (*ArchiveEntry, error) {
+	if upload.EntriesIndexedAt == nil {
+		if err := s.indexArchive(upload); err != nil {
+			return nil, err
+		}
+	}
+
+	var entry ArchiveEntry
+	if err := DB.Where("upload_id = ? AND path = ?", upload.ID, entryPath).First(&entry).Error; err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// openArchiveEntry streams the contents of one entry. Zip entries and entries
+// of plain tars are read with a ranged GET of just their data; compressed tars
+// have to be read from the start up to the entry.
+func (s *S3Client) openArchiveEntry(upload Upload, entry ArchiveEntry) (io.ReadCloser, error) {
+	if entry.Encrypted {
+		return nil, fmt.Errorf("%s is encrypted", entry.Path)
+	}
+
+	switch format := archiveFormatOf(upload.Filename); format {
+	case "zip":
+		zr, err := s.openZip(upload)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if f.Mode().IsRegular() && archivePath(f.Name, "") == entry.Path {
+				return s.openZipFile(upload, f)
+			}
+		}
+	case "tar", "tar.gz", "tar.zst":
+		if entry.DataOffset != nil {
+			return s.getFileRange(upload.FileKey, *entry.DataOffset, entry.Size)
+		}
+
+		tr, closer, err := s.openTar(upload, format)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				closer.Close()
+				if err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			if hdr.Typeflag == tar.TypeReg && archivePath(hdr.Name, "") == entry.Path {
+				return &readCloser{Reader: tr, close: closer.Close}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s not found in archive", entry.Path)
+}
+
+// openZipFile streams one zip member with a single ranged GET of its data.
+func (s *S3Client) openZipFile(upload Upload, f *zip.File) (io.ReadCloser, error) {
+	offset, err := f.DataOffset()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := s.getFileRange(upload.FileKey, offset, int64(f.CompressedSize64))
+	if err != nil {
+		return nil, err
+	}
+
+	switch f.Method {
+	case zip.Store:
+		return raw, nil
+	case zip.Deflate:
+		fr := flate.NewReader(raw)
+		return &readCloser{Reader: fr, close: func() error {
+			fr.Close()
+			return raw.Close()
+		}}, nil
+	}
+	raw.Close()
+	return nil, fmt.Errorf("%s uses unsupported compression method %d", f.Name, f.Method)
+}
+
+// sendArchiveEntry streams one entry of an archive upload to the client as an
+// attachment. Like sendUpload it returns an error without writing a response
+// when the entry can't be opened.
+func (s *S3Client) sendArchiveEntry(ctx *fiber.Ctx, upload *Upload, entry *ArchiveEntry) error {
+	stream, err := s.openArchiveEntry(*upload, *entry)
+	if err != nil {
+		return err
+	}
+
+	contentType := mime.TypeByExtension(strings.ToLower(path.Ext(entry.Path)))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	ctx.Set(fiber.HeaderContentType, contentType)
+	ctx.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"%s\"", path.Base(entry.Path)))
+
+	// The response body is read after the handler returns and closed once sent.
+	// If the entry doesn't match its header the transfer fails partway, so the
+	// client sees a broken download rather than a complete-looking wrong file.
+	body := &readCloser{Reader: newEntryReader(stream, entry.Size), close: stream.Close}
+	return ctx.SendStream(body, int(entry.Size))
+}
+
+// maxListedEntries caps how many entries the contents page shows; JSON
+// clients always get all of them.
+const maxListedEntries = 2000
+
+// entryInfo is the JSON representation of one archive entry.
+type entryInfo struct {
+	Path      string     `json:"path"`
+	Size      int64      `json:"size"`
+	Modified  *time.Time `json:"modified,omitempty"`
+	URL       string     `json:"url"`
+	Available bool       `json:"available"`
+}
+
+// entryURL is where the entry at entryPath of the archive behind shareID is
+// downloaded. Each path segment is escaped on its own so the slashes stay.
+func entryURL(shareID, entryPath string) string {
+	segments := strings.Split(entryPath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return fmt.Sprintf("%s/entry/%s", shareURL(shareID), strings.Join(segments, "/"))
+}
+
+func toEntryInfo(shareID string, entry ArchiveEntry) entryInfo {
+	return entryInfo{
+		Path:      entry.Path,
+		Size:      entry.Size,
+		Modified:  entry.Modified,
+		URL:       entryURL(shareID, entry.Path),
+		Available: !entry.Encrypted,
+	}
+}
+
+// renderEntriesPage renders the contents of an archive share. When the link
+// has a password, unlock is a token from unlockToken and each download is a
+// form posting it.
+func renderEntriesPage(shareID string, upload Upload, entries []ArchiveEntry, unlock string) string {
+	download := func(action, label string) string {
+		if unlock == "" {
+			return fmt.Sprintf(`<a class="button is-small is-primary is-light" href="%s">%s</a>`, action, label)
+		}
+		return fmt.Sprintf(`<form method="post" action="%s"><input type="hidden" name="unlock" value="%s"><button class="button is-small is-primary is-light" type="submit">%s</button></form>`,
+			action, html.EscapeString(unlock), label)
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	var rows strings.Builder
+	for i, entry := range entries {
+		if i == maxListedEntries {
+			fmt.Fprintf(&rows, `
+                <p class="has-text-grey">…and %d more files. Download the whole archive to get them all.</p>`, len(entries)-i)
+			break
+		}
+
+		action := `<span class="tag is-warning is-light">Encrypted</span>`
+		if !entry.Encrypted {
+			action = download(entryURL(shareID, entry.Path), "⬇️ Download")
+		}
+
+		fmt.Fprintf(&rows, `
+                <div class="is-flex is-align-items-center py-2" style="gap: 1rem; border-top: 1px solid #eee;">
+                    <div style="flex: 1; min-width: 0;">
+                        <div style="overflow-wrap: anywhere;">%s</div>
+                        <div class="has-text-grey is-size-7">%s</div>
+                    </div>
+                    %s
+                </div>`, html.EscapeString(entry.Path), formatBytes(uint64(entry.Size)), action)
+	}
+
+	return fmt.Sprintf(`<!Doctype html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/bulma@1.0.4/css/bulma.min.css">
+    <title>%s - Supashare</title>
+</head>
+<body>
+    <section class="section">
+        <div class="container" style="max-width: 48rem;">
+            <div class="title is-3" style="overflow-wrap: anywhere;">📦 %s</div>
+            <p class="subtitle is-6 has-text-grey">%d files · %s unpacked · %s archive</p>
+            <div class="mb-4">%s</div>
+            <div class="box">%s
+            </div>
+        </div>
+    </section>
+</body>
+</html>`, html.EscapeString(upload.Filename), html.EscapeString(upload.Filename), len(entries), formatBytes(uint64(total)),
+		formatBytes(uint64(upload.FileSize)), download(shareURL(shareID), "⬇️ Download whole archive"), rows.String())
+}
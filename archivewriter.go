@@ -0,0 +1,197 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveFormat describes one of the formats /create-zip can produce.
+type archiveFormat struct {
+	Ext         string
+	ContentType string
+}
+
+var archiveFormats = map[string]archiveFormat{
+	"zip":     {Ext: ".zip", ContentType: "application/zip"},
+	"tar":     {Ext: ".tar", ContentType: "application/x-tar"},
+	"tar.gz":  {Ext: ".tar.gz", ContentType: "application/gzip"},
+	"tar.zst": {Ext: ".tar.zst", ContentType: "application/zstd"},
+}
+
+// archiveContentType returns the content type of an archive filename, or ""
+// when filename doesn't have an archive extension.
+func archiveContentType(filename string) string {
+	lower := strings.ToLower(filename)
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(lower, format.Ext) {
+			return format.ContentType
+		}
+	}
+	return ""
+}
+
+// defaultFileMode is used for entries whose mode wasn't sent.
+const defaultFileMode fs.FileMode = 0o644
+
+// archiveHeader describes one file in an archive.
+type archiveHeader struct {
+	Name     string
+	Size     int64
+	Mode     fs.FileMode
+	Modified time.Time
+}
+
+// archiveWriter writes files into an archive of some format. Files are added
+// one at a time from a reader, so nothing has to be held in memory.
+type archiveWriter interface {
+	// Add writes a file to the archive. r must yield exactly hdr.Size bytes.
+	Add(hdr archiveHeader, r io.Reader) error
+	// Close finishes the archive; it doesn't close the underlying writer.
+	Close() error
+}
+
+// newArchiveWriter returns a writer producing opts.Format on w.
+func newArchiveWriter(w io.Writer, opts ArchiveOptions) (archiveWriter, error) {
+	switch opts.Format {
+	case "zip":
+		return newZipArchive(w, opts)
+	case "tar":
+		return &tarArchive{tw: tar.NewWriter(w)}, nil
+	case "tar.gz":
+		level := map[string]int{
+			"auto":  gzip.DefaultCompression,
+			"fast":  gzip.BestSpeed,
+			"best":  gzip.BestCompression,
+			"store": gzip.NoCompression,
+		}[opts.Compression]
+		gz, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchive{tw: tar.NewWriter(gz), compressor: gz}, nil
+	case "tar.zst":
+		// zstd has no stored mode, so "store" falls back to its fastest level.
+		level := map[string]zstd.EncoderLevel{
+			"auto":  zstd.SpeedDefault,
+			"fast":  zstd.SpeedFastest,
+			"best":  zstd.SpeedBestCompression,
+			"store": zstd.SpeedFastest,
+		}[opts.Compression]
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchive{tw: tar.NewWriter(zw), compressor: zw}, nil
+	}
+	return nil, fmt.Errorf("unsupported archive format %q", opts.Format)
+}
+
+// zipArchive writes zip archives. Already-compressed types are stored as-is
+// unless the compression is "store", which stores everything. With a password
+// every entry is WinZip AES encrypted.
+type zipArchive struct {
+	zw          *zip.Writer
+	compression string
+	password    string
+	// method is the compression of the entry being added, which the AES
+	// compressor needs since the entry's own method is winzipAESMethod.
+	method uint16
+}
+
+func newZipArchive(w io.Writer, opts ArchiveOptions) (*zipArchive, error) {
+	a := &zipArchive{zw: zip.NewWriter(w), compression: opts.Compression, password: opts.Password}
+
+	level, ok := compressionLevels[opts.Compression]
+	if ok {
+		a.zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	} else {
+		level = flate.DefaultCompression
+	}
+	if a.password != "" {
+		a.zw.RegisterCompressor(winzipAESMethod, func(out io.Writer) (io.WriteCloser, error) {
+			return newWinzipAESWriter(out, a.password, a.method, level)
+		})
+	}
+
+	if err := a.zw.SetComment(opts.Comment); err != nil {
+		return nil, fmt.Errorf("failed to set zip comment: %w", err)
+	}
+	return a, nil
+}
+
+func (a *zipArchive) Add(hdr archiveHeader, r io.Reader) error {
+	method := zipMethod(hdr.Name)
+	if a.compression == "store" {
+		method = zip.Store
+	}
+
+	fh := &zip.FileHeader{Name: hdr.Name, Method: method, Modified: hdr.Modified}
+	if hdr.Mode != 0 {
+		fh.SetMode(hdr.Mode)
+	}
+	if a.password != "" {
+		a.method = method
+		fh.Method = winzipAESMethod
+		fh.Flags |= 0x1 // encrypted
+		fh.Extra = winzipAESExtra(method)
+	}
+
+	out, err := a.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+// tarArchive writes tarballs, optionally through a compressor that is closed
+// along with the archive.
+type tarArchive struct {
+	tw         *tar.Writer
+	compressor io.Closer
+}
+
+func (a *tarArchive) Add(hdr archiveHeader, r io.Reader) error {
+	mode := hdr.Mode
+	if mode == 0 {
+		mode = defaultFileMode
+	}
+
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     hdr.Name,
+		Size:     hdr.Size,
+		Mode:     int64(mode.Perm()),
+		ModTime:  hdr.Modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, r)
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.compressor != nil {
+		return a.compressor.Close()
+	}
+	return nil
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// chunkSize matches the chunk size the web interface uses for /upload/chunk.
+const chunkSize = 5 * 1024 * 1024
+
+// Share mirrors the JSON the server returns for an upload.
+type Share struct {
+	ShareLink  string     `json:"share_link"`
+	URL        string     `json:"url"`
+	Slug       string     `json:"slug,omitempty"`
+	VanityURL  string     `json:"vanity_url,omitempty"`
+	Filename   string     `json:"filename"`
+	FileSize   int64      `json:"file_size"`
+	UploadedAt time.Time  `json:"uploaded_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Links      []Link     `json:"links"`
+}
+
+// Link mirrors the JSON the server returns for one share link.
+type Link struct {
+	Link         string     `json:"link"`
+	URL          string     `json:"url"`
+	Slug         string     `json:"slug,omitempty"`
+	VanityURL    string     `json:"vanity_url,omitempty"`
+	Label        string     `json:"label,omitempty"`
+	Password     bool       `json:"password"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads *int       `json:"max_downloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	Status       string     `json:"status"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// Collection mirrors the JSON the server returns for a collection.
+type Collection struct {
+	Link      string    `json:"link"`
+	URL       string    `json:"url"`
+	Title     string    `json:"title,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	TotalSize int64     `json:"total_size"`
+	Files     []struct {
+		ID       uint   `json:"id"`
+		Filename string `json:"filename"`
+		FileSize int64  `json:"file_size"`
+		URL      string `json:"url"`
+	} `json:"files"`
+}
+
+type CompressResult struct {
+	Shares []Share  `json:"shares"`
+	Failed []string `json:"failed"`
+}
+
+// UploadOptions are the optional form values every upload endpoint accepts.
+// Apart from LinkStyle they set the policy of the new share link.
+type UploadOptions struct {
+	Expire       string
+	LinkStyle    string
+	Label        string
+	Password     string
+	MaxDownloads string
+	// StripMetadata asks the server to remove location and camera details
+	// from photos and videos before storing them.
+	StripMetadata bool
+}
+
+func (o UploadOptions) fields(token string) map[string]string {
+	fields := map[string]string{
+		"user_id":       token,
+		"expire":        o.Expire,
+		"link_style":    o.LinkStyle,
+		"label":         o.Label,
+		"password":      o.Password,
+		"max_downloads": o.MaxDownloads,
+	}
+	if o.StripMetadata {
+		fields["strip_metadata"] = "true"
+	}
+	return fields
+}
+
+type Client struct {
+	cfg  *Config
+	http *http.Client
+}
+
+func newClient(cfg *Config) *Client {
+	return &Client{cfg: cfg, http: &http.Client{}}
+}
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// do sends req and decodes a JSON response into out. Error responses from the
+// server are HTML fragments, so their tags are stripped for the error message.
+func (c *Client) do(req *http.Request, out any) error {
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		msg := strings.TrimSpace(tagPattern.ReplaceAllString(string(body), ""))
+		if msg == "" {
+			msg = resp.Status
+		}
+		return fmt.Errorf("server returned %d: %s", resp.StatusCode, msg)
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response from %s: %w", req.URL.Path, err)
+	}
+	return nil
+}
+
+// UploadFile sends path to /upload/chunk in the same chunk size as the web UI and
+// returns the share created once the last chunk has been assembled.
+func (c *Client) UploadFile(path string, opts UploadOptions) (*Share, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	filename := filepath.Base(path)
+	uploadID := uuid.New().String()
+	total := max(int((info.Size()+chunkSize-1)/chunkSize), 1)
+
+	bar := newProgressBar(filename, info.Size())
+	defer bar.Finish()
+
+	chunk := make([]byte, chunkSize)
+	var share Share
+	for index := range total {
+		n, err := io.ReadFull(file, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		fields := opts.fields(c.cfg.Token)
+		fields["upload_id"] = uploadID
+		fields["filename"] = filename
+		fields["index"] = strconv.Itoa(index)
+		fields["total"] = strconv.Itoa(total)
+
+		body, contentType, err := multipartBody(fields, func(w *multipart.Writer) error {
+			part, err := w.CreateFormFile("chunk", filename)
+			if err != nil {
+				return err
+			}
+			_, err = part.Write(chunk[:n])
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, c.cfg.Server+"/upload/chunk", body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+
+		if index == total-1 {
+			err = c.do(req, &share)
+		} else {
+			err = c.do(req, nil)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d/%d of %s: %w", index+1, total, filename, err)
+		}
+
+		bar.Add(int64(n))
+	}
+
+	return &share, nil
+}
+
+func (c *Client) ListShares() ([]Share, error) {
+	query := url.Values{"user_id": {c.cfg.Token}}
+	req, err := http.NewRequest(http.MethodGet, c.cfg.Server+"/my-shares?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var shares []Share
+	if err := c.do(req, &shares); err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+func (c *Client) DeleteShare(shareID string) error {
+	query := url.Values{"user_id": {c.cfg.Token}}
+	req, err := http.NewRequest(http.MethodDelete, c.cfg.Server+"/share/"+url.PathEscape(shareID)+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, nil)
+}
+
+// Links returns the upload a link belongs to with all of its links.
+func (c *Client) Links(shareID string) (*Share, error) {
+	query := url.Values{"user_id": {c.cfg.Token}}
+	req, err := http.NewRequest(http.MethodGet, c.cfg.Server+"/share/"+url.PathEscape(shareID)+"/links?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var share Share
+	if err := c.do(req, &share); err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+// CreateLink adds another link, with its own policy, to the upload shareID
+// belongs to.
+func (c *Client) CreateLink(shareID string, opts UploadOptions) (*Link, error) {
+	form := url.Values{}
+	for key, value := range opts.fields(c.cfg.Token) {
+		form.Set(key, value)
+	}
+	return c.postLink(http.MethodPost, shareID, "/links", form)
+}
+
+func (c *Client) RevokeLink(shareID string) (*Link, error) {
+	return c.postLink(http.MethodPost, shareID, "/revoke", url.Values{"user_id": {c.cfg.Token}})
+}
+
+// RotateLink replaces a link with a new random one; the old URL stops working.
+func (c *Client) RotateLink(shareID string) (*Link, error) {
+	return c.postLink(http.MethodPost, shareID, "/rotate", url.Values{"user_id": {c.cfg.Token}})
+}
+
+// SetSlug sets the vanity slug of a link, or removes it when slug is empty.
+func (c *Client) SetSlug(shareID, slug string) (*Link, error) {
+	return c.postLink(http.MethodPut, shareID, "/slug", url.Values{"user_id": {c.cfg.Token}, "slug": {slug}})
+}
+
+func (c *Client) postLink(method, shareID, action string, form url.Values) (*Link, error) {
+	req, err := http.NewRequest(method, c.cfg.Server+"/share/"+url.PathEscape(shareID)+action, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var link Link
+	if err := c.do(req, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// CreateCollection groups the files behind shareIDs under one collection link.
+func (c *Client) CreateCollection(shareIDs []string, title, linkStyle string) (*Collection, error) {
+	form := url.Values{"user_id": {c.cfg.Token}, "title": {title}, "link_style": {linkStyle}, "share_ids": shareIDs}
+	req, err := http.NewRequest(http.MethodPost, c.cfg.Server+"/collections", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var collection Collection
+	if err := c.do(req, &collection); err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+// Download saves the shared file under its original filename in the working
+// directory, or to output when it is set, and returns the path written. The
+// password is posted for password-protected links.
+func (c *Client) Download(shareID, output, password string) (string, error) {
+	shareURL := c.cfg.Server + "/share/" + url.PathEscape(shareID)
+
+	var resp *http.Response
+	var err error
+	if password != "" {
+		resp, err = c.http.PostForm(shareURL, url.Values{"password": {password}})
+	} else {
+		resp, err = c.http.Get(shareURL)
+	}
+	if err != nil {
+		return "", fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		if password != "" {
+			return "", fmt.Errorf("wrong password")
+		}
+		return "", fmt.Errorf("this share is password protected; pass --password")
+	}
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("server returned %d: %s", resp.StatusCode, strings.TrimSpace(tagPattern.ReplaceAllString(string(body), "")))
+	}
+
+	if output == "" {
+		output = shareID
+		if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+			output = filepath.Base(params["filename"])
+		}
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	bar := newProgressBar(filepath.Base(output), resp.ContentLength)
+	defer bar.Finish()
+
+	if _, err := io.Copy(io.MultiWriter(file, bar), resp.Body); err != nil {
+		return "", fmt.Errorf("download interrupted: %w", err)
+	}
+	return output, nil
+}
+
+// ZipOptions are the archive settings of CreateZip.
+type ZipOptions struct {
+	Name        string
+	Format      string
+	Compression string
+	Comment     string
+	Manifest    bool
+	Password    string
+	Split       string // part size such as "25MB"; empty stores one archive
+}
+
+// CreateZip uploads files as one archive, a zip unless archive.Format says
+// otherwise. names holds each file's path inside the archive, in the same
+// order as paths, and each file's permissions are sent along for tarballs.
+// Files already shared are added by listing their share IDs in shareIDs.
+// A split archive comes back as the collection of its parts, so only the
+// returned URL, the collection's, is set.
+func (c *Client) CreateZip(paths, names, shareIDs []string, archive ZipOptions, opts UploadOptions) (*Share, error) {
+	modes := make([]string, len(paths))
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modes[i] = strconv.FormatUint(uint64(info.Mode().Perm()), 8)
+	}
+
+	fields := opts.fields(c.cfg.Token)
+	fields["archive_name"] = archive.Name
+	fields["format"] = archive.Format
+	fields["compression"] = archive.Compression
+	fields["comment"] = archive.Comment
+	fields["archive_password"] = archive.Password
+	fields["split"] = archive.Split
+	if archive.Manifest {
+		fields["manifest"] = "true"
+	}
+
+	values := formValues(fields)
+	values["paths"] = names
+	values["modes"] = modes
+	values["share_ids"] = shareIDs
+
+	var share Share
+	if err := c.postFiles("/create-zip", "zip-files", paths, values, &share); err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+// CompressOptions are the media settings of Compress; empty values leave
+// them to the server.
+type CompressOptions struct {
+	Quality    string // high, medium or low
+	Format     string // image format: auto, jpeg, png, webp or original
+	Background string // color transparent images saved as JPEG are put on, such as "#ffffff"
+	Animation  string // what animated GIFs become: gif, mp4 or webm
+}
+
+// Compress uploads images and videos to be compressed as media says.
+func (c *Client) Compress(paths []string, media CompressOptions, opts UploadOptions) (*CompressResult, error) {
+	fields := opts.fields(c.cfg.Token)
+	fields["quality"] = media.Quality
+	fields["format"] = media.Format
+	fields["background"] = media.Background
+	fields["animation"] = media.Animation
+
+	var result CompressResult
+	if err := c.postFiles("/compress-media", "media-files", paths, formValues(fields), &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// postFiles streams a multipart form with every file in paths under fieldName.
+// Each part carries the Content-Type guessed from its extension because
+// /compress-media sorts images from videos by it.
+func (c *Client) postFiles(endpoint, fieldName string, paths []string, fields url.Values, out any) error {
+	var totalSize int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		totalSize += info.Size()
+	}
+
+	bar := newProgressBar(endpoint, totalSize)
+	defer bar.Finish()
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	go func() {
+		err := writeValues(writer, fields)
+		for _, path := range paths {
+			if err != nil {
+				break
+			}
+			err = writeFilePart(writer, fieldName, path, bar)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, c.cfg.Server+endpoint, pr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return c.do(req, out)
+}
+
+func writeFilePart(writer *multipart.Writer, fieldName, path string, bar *progressBar) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, fieldName, filepath.Base(path)))
+	header.Set("Content-Type", contentType)
+
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(part, &progressReader{Reader: file, bar: bar})
+	return err
+}
+
+func writeFields(writer *multipart.Writer, fields map[string]string) error {
+	for name, value := range fields {
+		if value == "" {
+			continue
+		}
+		if err := writer.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formValues drops the empty fields, which the server treats as unset anyway.
+func formValues(fields map[string]string) url.Values {
+	values := make(url.Values)
+	for name, value := range fields {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	return values
+}
+
+func writeValues(writer *multipart.Writer, values url.Values) error {
+	for name, list := range values {
+		for _, value := range list {
+			if err := writer.WriteField(name, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func multipartBody(fields map[string]string, writeFiles func(*multipart.Writer) error) (*bytes.Buffer, string, error) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+
+	if err := writeFields(writer, fields); err != nil {
+		return nil, "", err
+	}
+	if err := writeFiles(writer); err != nil {
+		return nil, "", err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return body, writer.FormDataContentType(), nil
+}
+
+// shareIDFromArg accepts either a bare share ID or a full share URL.
+func shareIDFromArg(arg string) string {
+	if i := strings.LastIndex(arg, "/share/"); i >= 0 {
+		arg = arg[i+len("/share/"):]
+	}
+	return strings.Trim(arg, "/")
+}
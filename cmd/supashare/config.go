@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Config holds the settings the CLI needs to talk to a Supashare server.
+// Token is the user ID the server keys uploads on; the web interface keeps
+// the same value in localStorage under "supashare_user_id".
+type Config struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+func defaultConfigPath() string {
+	if path := os.Getenv("SUPASHARE_CONFIG"); path != "" {
+		return path
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "supashare.json"
+	}
+	return filepath.Join(dir, "supashare", "config.json")
+}
+
+// loadConfig reads the config file at path. SUPASHARE_SERVER and SUPASHARE_TOKEN
+// override the file so the CLI can run in CI without one.
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+		}
+	}
+
+	if server := os.Getenv("SUPASHARE_SERVER"); server != "" {
+		cfg.Server = server
+	}
+	if token := os.Getenv("SUPASHARE_TOKEN"); token != "" {
+		cfg.Token = token
+	}
+
+	if cfg.Server == "" {
+		return nil, fmt.Errorf("no server configured: set \"server\" in %s or SUPASHARE_SERVER", path)
+	}
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("no token configured: set \"token\" in %s or SUPASHARE_TOKEN", path)
+	}
+
+	cfg.Server = strings.TrimSuffix(cfg.Server, "/")
+	return cfg, nil
+}
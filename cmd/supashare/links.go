@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func runLinks(client *Client, args []string) error {
+	fs := flag.NewFlagSet("links", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("expected exactly one share")
+	}
+
+	share, err := client.Links(shareIDFromArg(positional[0]))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(share)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LINK\tSTATUS\tDOWNLOADS\tEXPIRES\tPASSWORD\tLABEL")
+	for _, link := range share.Links {
+		id := link.Link
+		if link.Slug != "" {
+			id += " (" + link.Slug + ")"
+		}
+		downloads := fmt.Sprint(link.Downloads)
+		if link.MaxDownloads != nil {
+			downloads += fmt.Sprintf("/%d", *link.MaxDownloads)
+		}
+		expires := "never"
+		if link.ExpiresAt != nil {
+			expires = link.ExpiresAt.Local().Format(time.DateTime)
+		}
+		password := "no"
+		if link.Password {
+			password = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", id, link.Status, downloads, expires, password, link.Label)
+	}
+	return tw.Flush()
+}
+
+func runLink(client *Client, args []string) error {
+	fs := flag.NewFlagSet("link", flag.ExitOnError)
+	opts := uploadFlags(fs)
+	asJSON := fs.Bool("json", false, "print JSON instead of the link URL")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("expected exactly one share")
+	}
+
+	link, err := client.CreateLink(shareIDFromArg(positional[0]), *opts)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(link)
+	}
+	fmt.Println(link.URL)
+	return nil
+}
+
+func runRevoke(client *Client, args []string) error {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return fmt.Errorf("no links given")
+	}
+
+	var revoked []*Link
+	for _, arg := range positional {
+		shareID := shareIDFromArg(arg)
+		link, err := client.RevokeLink(shareID)
+		if err != nil {
+			return fmt.Errorf("%s: %w", shareID, err)
+		}
+		revoked = append(revoked, link)
+
+		if !*asJSON {
+			fmt.Printf("revoked %s\n", link.Link)
+		}
+	}
+
+	if *asJSON {
+		return printJSON(revoked)
+	}
+	return nil
+}
+
+func runRotate(client *Client, args []string) error {
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON instead of the new link URL")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("expected exactly one link")
+	}
+
+	link, err := client.RotateLink(shareIDFromArg(positional[0]))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(link)
+	}
+	fmt.Println(link.URL)
+	return nil
+}
+
+func runSlug(client *Client, args []string) error {
+	fs := flag.NewFlagSet("slug", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) < 1 || len(positional) > 2 {
+		return fmt.Errorf("expected a share and an optional slug")
+	}
+
+	slug := ""
+	if len(positional) == 2 {
+		slug = positional[1]
+	}
+
+	link, err := client.SetSlug(shareIDFromArg(positional[0]), slug)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(link)
+	}
+	if link.VanityURL != "" {
+		fmt.Println(link.VanityURL)
+	} else {
+		fmt.Println(link.URL)
+	}
+	return nil
+}
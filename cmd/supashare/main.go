@@ -0,0 +1,419 @@
+// Command supashare is a command-line client for a Supashare server.
+//
+//	supashare upload build.tar.gz --expire 7d
+//	supashare ls --json
+//	supashare get <share> [-o file]
+//	supashare rm <share>...
+//	supashare zip <file-or-dir>... [--name docs.zip] [--manifest]
+//	supashare zip --shares <share>... [--format tar.gz]
+//	supashare compress <file>... [--quality medium] [--format webp]
+//	supashare sync <dir> [--delete] [--once]
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: supashare [--config path] <command> [flags] [args]
+
+Commands:
+  upload <file>...    upload files and print their share URLs
+  ls                  list your shares
+  get <share>         download a share by ID or URL
+  rm <share>...       delete shares
+  links <share>       list every link to a share's file
+  link <share>        add another link to a share's file
+  revoke <share>...   revoke links
+  rotate <share>      replace a link with a new one
+  slug <share> [slug] set a custom link for a share, or remove it
+  collect <share>...  group shares under one collection link
+  zip <path>...       upload files and directories as a single zip or tar archive
+  compress <file>...  compress images and videos and upload the results
+  sync <dir>          upload new and changed files in dir as they appear
+
+Run "supashare <command> -h" for command flags.
+`
+
+func main() {
+	global := flag.NewFlagSet("supashare", flag.ExitOnError)
+	configPath := global.String("config", defaultConfigPath(), "path to the config file")
+	global.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	global.Parse(os.Args[1:])
+
+	if global.NArg() == 0 {
+		global.Usage()
+		os.Exit(2)
+	}
+
+	command, args := global.Arg(0), global.Args()[1:]
+
+	commands := map[string]func(*Client, []string) error{
+		"upload":   runUpload,
+		"ls":       runList,
+		"get":      runGet,
+		"rm":       runRemove,
+		"links":    runLinks,
+		"link":     runLink,
+		"revoke":   runRevoke,
+		"rotate":   runRotate,
+		"slug":     runSlug,
+		"collect":  runCollect,
+		"zip":      runZip,
+		"compress": runCompress,
+		"sync":     runSync,
+	}
+
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "supashare: unknown command %q\n\n", command)
+		global.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "supashare: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := run(newClient(cfg), args); err != nil {
+		fmt.Fprintf(os.Stderr, "supashare %s: %v\n", command, err)
+		os.Exit(1)
+	}
+}
+
+// parseFlags parses flags that may appear before or after positional arguments,
+// so both "upload --expire 7d f" and "upload f --expire 7d" work.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// uploadFlags registers the flags shared by every command that creates shares.
+func uploadFlags(fs *flag.FlagSet) *UploadOptions {
+	opts := &UploadOptions{}
+	fs.StringVar(&opts.Expire, "expire", "", "expire shares after this long (e.g. 12h, 7d, 2w)")
+	fs.StringVar(&opts.LinkStyle, "link-style", "", "share link style: random, words or secure (server default if unset)")
+	fs.StringVar(&opts.Label, "label", "", "label for the share link, e.g. \"for ACME legal\"")
+	fs.StringVar(&opts.Password, "password", "", "require this password to download")
+	fs.StringVar(&opts.MaxDownloads, "max-downloads", "", "stop the link working after this many downloads")
+	fs.BoolVar(&opts.StripMetadata, "strip-metadata", false, "remove location and camera details from photos and videos")
+	return opts
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func runUpload(client *Client, args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	opts := uploadFlags(fs)
+	collect := fs.Bool("collection", false, "also group the uploaded files under one collection link")
+	title := fs.String("title", "", "title of the collection")
+	asJSON := fs.Bool("json", false, "print JSON instead of share URLs")
+
+	paths, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no files given")
+	}
+	if *collect && opts.Password != "" {
+		return fmt.Errorf("collections can't be password-protected; drop --password or --collection")
+	}
+
+	var shares []Share
+	for _, path := range paths {
+		share, err := client.UploadFile(path, *opts)
+		if err != nil {
+			return err
+		}
+		shares = append(shares, *share)
+
+		if !*asJSON {
+			fmt.Println(share.URL)
+		}
+	}
+
+	if !*collect {
+		if *asJSON {
+			return printJSON(shares)
+		}
+		return nil
+	}
+
+	links := make([]string, len(shares))
+	for i, share := range shares {
+		links[i] = share.ShareLink
+	}
+	collection, err := client.CreateCollection(links, *title, opts.LinkStyle)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(map[string]any{"shares": shares, "collection": collection})
+	}
+	fmt.Printf("collection %s\n", collection.URL)
+	return nil
+}
+
+func runCollect(client *Client, args []string) error {
+	fs := flag.NewFlagSet("collect", flag.ExitOnError)
+	title := fs.String("title", "", "title of the collection")
+	linkStyle := fs.String("link-style", "", "collection link style: random, words or secure (server default if unset)")
+	asJSON := fs.Bool("json", false, "print JSON instead of the collection URL")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return fmt.Errorf("no shares given")
+	}
+
+	links := make([]string, len(positional))
+	for i, arg := range positional {
+		links[i] = shareIDFromArg(arg)
+	}
+
+	collection, err := client.CreateCollection(links, *title, *linkStyle)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(collection)
+	}
+	fmt.Println(collection.URL)
+	return nil
+}
+
+func runList(client *Client, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON")
+
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	shares, err := client.ListShares()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(shares)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SHARE\tSIZE\tUPLOADED\tEXPIRES\tFILENAME")
+	for _, share := range shares {
+		expires := "never"
+		if share.ExpiresAt != nil {
+			expires = share.ExpiresAt.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			share.ShareLink,
+			formatBytes(share.FileSize),
+			share.UploadedAt.Local().Format(time.DateTime),
+			expires,
+			share.Filename,
+		)
+	}
+	return tw.Flush()
+}
+
+func runGet(client *Client, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	output := fs.String("o", "", "write to this path instead of the shared filename")
+	password := fs.String("password", "", "password for a protected share")
+	asJSON := fs.Bool("json", false, "print JSON")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("expected exactly one share")
+	}
+
+	shareID := shareIDFromArg(positional[0])
+	path, err := client.Download(shareID, *output, *password)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(map[string]string{"share_link": shareID, "path": path})
+	}
+	fmt.Println(path)
+	return nil
+}
+
+func runRemove(client *Client, args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return fmt.Errorf("no shares given")
+	}
+
+	var deleted []string
+	for _, arg := range positional {
+		shareID := shareIDFromArg(arg)
+		if err := client.DeleteShare(shareID); err != nil {
+			return fmt.Errorf("%s: %w", shareID, err)
+		}
+		deleted = append(deleted, shareID)
+
+		if !*asJSON {
+			fmt.Printf("deleted %s\n", shareID)
+		}
+	}
+
+	if *asJSON {
+		return printJSON(map[string][]string{"deleted": deleted})
+	}
+	return nil
+}
+
+func runZip(client *Client, args []string) error {
+	fs := flag.NewFlagSet("zip", flag.ExitOnError)
+	opts := uploadFlags(fs)
+	var archive ZipOptions
+	fs.StringVar(&archive.Name, "name", "", "archive name (default archive_<time> with the format's extension)")
+	fs.StringVar(&archive.Format, "format", "zip", "archive format: zip, tar, tar.gz or tar.zst")
+	fs.StringVar(&archive.Compression, "compression", "auto", "compression: auto, store, fast or best")
+	fs.StringVar(&archive.Comment, "comment", "", "zip comment")
+	fs.BoolVar(&archive.Manifest, "manifest", false, "add a SHA256SUMS manifest to the archive")
+	fs.StringVar(&archive.Password, "archive-password", "", "encrypt zip entries with AES-256 using this password")
+	fs.StringVar(&archive.Split, "split", "", "store the archive as parts of at most this size, e.g. 25MB, shared as one collection")
+	fromShares := fs.Bool("shares", false, "arguments are existing shares to bundle rather than local files")
+	asJSON := fs.Bool("json", false, "print JSON instead of the share URL")
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("no files given")
+	}
+
+	var paths, names, shareIDs []string
+	if *fromShares {
+		for _, arg := range args {
+			shareIDs = append(shareIDs, shareIDFromArg(arg))
+		}
+	} else if paths, names, err = zipInputs(args); err != nil {
+		return err
+	}
+
+	share, err := client.CreateZip(paths, names, shareIDs, archive, *opts)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(share)
+	}
+	fmt.Println(share.URL)
+	return nil
+}
+
+// zipInputs expands args into the files to zip and their paths inside the
+// archive. Files go in under their own name; directories are walked and keep
+// their structure under the directory's name, like a folder upload in the
+// browser.
+func zipInputs(args []string) (paths, names []string, err error) {
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			names = append(names, filepath.Base(arg))
+			continue
+		}
+
+		root := filepath.Dir(filepath.Clean(arg))
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !d.Type().IsRegular() {
+				return err
+			}
+			name, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, path)
+			names = append(names, filepath.ToSlash(name))
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(paths) == 0 {
+		return nil, nil, fmt.Errorf("no files found")
+	}
+	return paths, names, nil
+}
+
+func runCompress(client *Client, args []string) error {
+	fs := flag.NewFlagSet("compress", flag.ExitOnError)
+	var media CompressOptions
+	fs.StringVar(&media.Quality, "quality", "medium", "compression quality: high, medium or low")
+	fs.StringVar(&media.Format, "format", "", "image output format: auto, jpeg, png, webp or original (default auto)")
+	fs.StringVar(&media.Background, "background", "", "color to put behind transparent images saved as JPEG (default #ffffff)")
+	fs.StringVar(&media.Animation, "animation", "", "what animated GIFs become: gif, mp4 or webm (default gif)")
+	opts := uploadFlags(fs)
+	asJSON := fs.Bool("json", false, "print JSON instead of share URLs")
+
+	paths, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no files given")
+	}
+
+	result, err := client.Compress(paths, media, *opts)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(result)
+	}
+	for _, share := range result.Shares {
+		fmt.Println(share.URL)
+	}
+	for _, failed := range result.Failed {
+		fmt.Fprintf(os.Stderr, "failed: %s\n", failed)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// progressBar renders a single-line progress bar on stderr. It stays silent
+// when stderr is not a terminal so scripted output isn't littered with \r.
+type progressBar struct {
+	label   string
+	total   int64
+	current int64
+	enabled bool
+}
+
+func newProgressBar(label string, total int64) *progressBar {
+	enabled := false
+	if info, err := os.Stderr.Stat(); err == nil {
+		enabled = info.Mode()&os.ModeCharDevice != 0
+	}
+	return &progressBar{label: label, total: total, enabled: enabled}
+}
+
+func (p *progressBar) Add(n int64) {
+	p.current += n
+	p.render()
+}
+
+func (p *progressBar) Write(b []byte) (int, error) {
+	p.Add(int64(len(b)))
+	return len(b), nil
+}
+
+func (p *progressBar) render() {
+	if !p.enabled {
+		return
+	}
+
+	const width = 30
+	if p.total <= 0 {
+		fmt.Fprintf(os.Stderr, "\r%s %s", p.label, formatBytes(p.current))
+		return
+	}
+
+	filled := int(float64(width) * float64(p.current) / float64(p.total))
+	filled = min(filled, width)
+	fmt.Fprintf(os.Stderr, "\r%s [%s%s] %3.0f%% %s/%s",
+		p.label,
+		strings.Repeat("=", filled),
+		strings.Repeat(" ", width-filled),
+		float64(p.current)/float64(p.total)*100,
+		formatBytes(p.current),
+		formatBytes(p.total),
+	)
+}
+
+func (p *progressBar) Finish() {
+	if p.enabled {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// progressReader reports bytes read from the wrapped reader to a progress bar.
+type progressReader struct {
+	io.Reader
+	bar *progressBar
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.bar.Add(int64(n))
+	return n, err
+}
+
+func formatBytes(bytes int64) string {
+	const (
+		KB = 1 << 10
+		MB = 1 << 20
+		GB = 1 << 30
+	)
+
+	switch {
+	case bytes >= GB:
+		return fmt.Sprintf("%.2f GB", float64(bytes)/GB)
+	case bytes >= MB:
+		return fmt.Sprintf("%.2f MB", float64(bytes)/MB)
+	case bytes >= KB:
+		return fmt.Sprintf("%.2f KB", float64(bytes)/KB)
+	default:
+		return fmt.Sprintf("%d B", bytes)
+	}
+}
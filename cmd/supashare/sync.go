@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const defaultStateFile = ".supashare-sync.json"
+
+// syncedFile records what was uploaded for one local file. Size and ModTime let
+// a rescan skip unchanged files cheaply; SHA256 catches files that were touched
+// or rewritten with identical contents so they aren't uploaded again.
+type syncedFile struct {
+	ShareLink string    `json:"share_link"`
+	URL       string    `json:"url"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	SHA256    string    `json:"sha256"`
+}
+
+type syncState struct {
+	Files map[string]*syncedFile `json:"files"`
+}
+
+func loadSyncState(path string) (*syncState, error) {
+	state := &syncState{Files: make(map[string]*syncedFile)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]*syncedFile)
+	}
+	return state, nil
+}
+
+// save writes the state through a temp file and rename so a crash mid-write
+// never leaves a truncated state file behind.
+func (s *syncState) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+type syncer struct {
+	client    *Client
+	dir       string
+	statePath string
+	state     *syncState
+	opts      UploadOptions
+	delete    bool
+	asJSON    bool
+}
+
+type syncEvent struct {
+	Action    string `json:"action"`
+	Path      string `json:"path"`
+	ShareLink string `json:"share_link,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (s *syncer) report(event syncEvent) {
+	if s.asJSON {
+		json.NewEncoder(os.Stdout).Encode(event)
+		return
+	}
+
+	switch {
+	case event.Error != "":
+		fmt.Fprintf(os.Stderr, "%s %s failed: %s\n", event.Action, event.Path, event.Error)
+	case event.URL != "":
+		fmt.Printf("%s %s %s\n", event.Action, event.Path, event.URL)
+	default:
+		fmt.Printf("%s %s\n", event.Action, event.Path)
+	}
+}
+
+// localFiles walks the sync directory and returns regular files keyed by their
+// slash-separated path relative to it. Dotfiles and dot-directories are skipped,
+// which also keeps the default state file and editor swap files out of the sync.
+func (s *syncer) localFiles() (map[string]fs.FileInfo, error) {
+	files := make(map[string]fs.FileInfo)
+
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != s.dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		abs, _ := filepath.Abs(path)
+		if abs == s.statePath || abs == s.statePath+".tmp" {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = info
+		return nil
+	})
+
+	return files, err
+}
+
+// scan brings the remote side in line with the directory: new and changed files
+// are uploaded, and with --delete, shares for removed or replaced files are
+// deleted. It saves the state after every change so a restart resumes cleanly.
+func (s *syncer) scan() error {
+	files, err := s.localFiles()
+	if err != nil {
+		return fmt.Errorf("failed to scan %s: %w", s.dir, err)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		info := files[name]
+		previous := s.state.Files[name]
+
+		if previous != nil && previous.Size == info.Size() && previous.ModTime.Equal(info.ModTime()) {
+			continue
+		}
+
+		path := filepath.Join(s.dir, filepath.FromSlash(name))
+		sum, err := fileSHA256(path)
+		if err != nil {
+			s.report(syncEvent{Action: "upload", Path: name, Error: err.Error()})
+			continue
+		}
+
+		if previous != nil && previous.SHA256 == sum {
+			previous.Size = info.Size()
+			previous.ModTime = info.ModTime()
+			if err := s.state.save(s.statePath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		share, err := s.client.UploadFile(path, s.opts)
+		if err != nil {
+			s.report(syncEvent{Action: "upload", Path: name, Error: err.Error()})
+			continue
+		}
+
+		s.state.Files[name] = &syncedFile{
+			ShareLink: share.ShareLink,
+			URL:       share.URL,
+			Size:      info.Size(),
+			ModTime:   info.ModTime(),
+			SHA256:    sum,
+		}
+		if err := s.state.save(s.statePath); err != nil {
+			return err
+		}
+		s.report(syncEvent{Action: "uploaded", Path: name, ShareLink: share.ShareLink, URL: share.URL})
+
+		if previous != nil && s.delete {
+			s.deleteRemote(name, previous)
+		}
+	}
+
+	for name, synced := range s.state.Files {
+		if _, ok := files[name]; ok {
+			continue
+		}
+
+		if s.delete {
+			s.deleteRemote(name, synced)
+		} else {
+			s.report(syncEvent{Action: "forgot", Path: name, ShareLink: synced.ShareLink})
+		}
+
+		delete(s.state.Files, name)
+		if err := s.state.save(s.statePath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *syncer) deleteRemote(name string, synced *syncedFile) {
+	if err := s.client.DeleteShare(synced.ShareLink); err != nil {
+		s.report(syncEvent{Action: "delete", Path: name, ShareLink: synced.ShareLink, Error: err.Error()})
+		return
+	}
+	s.report(syncEvent{Action: "deleted", Path: name, ShareLink: synced.ShareLink})
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func runSync(client *Client, args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	statePath := fs.String("state", "", "state file (default <dir>/"+defaultStateFile+")")
+	opts := uploadFlags(fs)
+	deleteRemote := fs.Bool("delete", false, "delete remote shares when local files are removed or replaced")
+	once := fs.Bool("once", false, "sync once and exit instead of watching")
+	settle := fs.Duration("settle", 2*time.Second, "wait this long after the last change before syncing")
+	interval := fs.Duration("interval", time.Minute, "rescan interval where inotify is unavailable")
+	asJSON := fs.Bool("json", false, "print one JSON event per line")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("expected exactly one directory")
+	}
+
+	dir, err := filepath.Abs(positional[0])
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	if *statePath == "" {
+		*statePath = filepath.Join(dir, defaultStateFile)
+	}
+	*statePath, err = filepath.Abs(*statePath)
+	if err != nil {
+		return err
+	}
+
+	state, err := loadSyncState(*statePath)
+	if err != nil {
+		return err
+	}
+
+	s := &syncer{
+		client:    client,
+		dir:       dir,
+		statePath: *statePath,
+		state:     state,
+		opts:      *opts,
+		delete:    *deleteRemote,
+		asJSON:    *asJSON,
+	}
+
+	if err := s.scan(); err != nil {
+		return err
+	}
+	if *once {
+		return nil
+	}
+
+	changes, stop, err := watchDir(dir, *interval)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	// Changes are batched until the directory has been quiet for the settle
+	// period, then a full rescan picks up everything that happened meanwhile.
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-signals:
+			return nil
+		case err, ok := <-changes:
+			if !ok {
+				return fmt.Errorf("watcher stopped")
+			}
+			if err != nil {
+				return err
+			}
+			timer = time.After(*settle)
+		case <-timer:
+			timer = nil
+			if err := s.scan(); err != nil {
+				return err
+			}
+		}
+	}
+}
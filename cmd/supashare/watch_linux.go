@@ -0,0 +1,140 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+	unix.IN_DELETE | unix.IN_CREATE | unix.IN_DELETE_SELF
+
+// watchDir watches dir and its subdirectories with inotify. A nil value on the
+// returned channel means something changed; a non-nil value is fatal. Files are
+// only reported once closed after writing, so half-written reports are skipped.
+func watchDir(dir string, _ time.Duration) (<-chan error, func(), error) {
+	// The descriptor is non-blocking and read through an os.File, so reads go
+	// through the runtime poller and closing the file wakes a pending read.
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, fmt.Errorf("inotify init failed: %w", err)
+	}
+	file := os.NewFile(uintptr(fd), "inotify")
+
+	watches := make(map[int]string)
+	addTree := func(root string) error {
+		return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			// Directories removed again before they are watched have nothing
+			// left to watch.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil || !d.IsDir() {
+				return err
+			}
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			wd, err := unix.InotifyAddWatch(fd, path, watchMask)
+			if errors.Is(err, unix.ENOENT) {
+				return filepath.SkipDir
+			}
+			if err != nil {
+				return fmt.Errorf("failed to watch %s: %w", path, err)
+			}
+			watches[wd] = path
+			return nil
+		})
+	}
+
+	if err := addTree(dir); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	changes := make(chan error, 1)
+	done := make(chan struct{})
+
+	// notify reports a change unless one is already pending, in which case
+	// the next rescan will see this one too.
+	notify := func() {
+		select {
+		case changes <- nil:
+		default:
+		}
+	}
+	// fail reports a fatal error, waiting for a pending change to be taken
+	// first, unless the watcher is being stopped.
+	fail := func(err error) {
+		select {
+		case changes <- err:
+		case <-done:
+		}
+	}
+
+	go func() {
+		defer close(changes)
+
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				select {
+				case <-done:
+				default:
+					fail(fmt.Errorf("inotify read failed: %w", err))
+				}
+				return
+			}
+
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+				name := strings.TrimRight(string(nameBytes), "\x00")
+				offset += unix.SizeofInotifyEvent + int(event.Len)
+
+				if event.Mask&unix.IN_DELETE_SELF != 0 && watches[int(event.Wd)] == dir {
+					fail(fmt.Errorf("%s was removed", dir))
+					return
+				}
+				if strings.HasPrefix(name, ".") {
+					continue
+				}
+
+				if event.Mask&unix.IN_ISDIR != 0 && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+					if err := addTree(filepath.Join(watches[int(event.Wd)], name)); err != nil {
+						fail(err)
+						return
+					}
+				}
+
+				// IN_CREATE on a plain file is followed by IN_CLOSE_WRITE once the
+				// writer is done, so only directories need to react to it.
+				if event.Mask&unix.IN_CREATE != 0 && event.Mask&unix.IN_ISDIR == 0 {
+					continue
+				}
+				notify()
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			file.Close()
+		})
+	}
+
+	return changes, stop, nil
+}
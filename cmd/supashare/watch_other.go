@@ -0,0 +1,36 @@
+//go:build !linux
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// watchDir falls back to rescanning every interval where inotify isn't available.
+func watchDir(_ string, interval time.Duration) (<-chan error, func(), error) {
+	changes := make(chan error, 1)
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				select {
+				case changes <- nil:
+				default:
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+
+	return changes, stop, nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// collectionURL is the landing page of a collection.
+func collectionURL(link string) string {
+	return fmt.Sprintf("%sc/%s", URL, link)
+}
+
+// errCollectionPassword refuses collection=true alongside a password: a
+// collection has no password of its own, so it could only list the files as
+// unavailable.
+var errCollectionPassword = errors.New("collections can't be password-protected; leave out the password or the collection")
+
+// createCollection groups uploadIDs under a new collection link. Uploads are
+// listed in the order given.
+func createCollection(userID, title string, uploadIDs []uint, style ShareIDStyle) (*Collection, error) {
+	if len(uploadIDs) == 0 {
+		return nil, fmt.Errorf("a collection needs at least one file")
+	}
+
+	var err error
+	for attempt := 1; attempt <= maxReserveAttempts; attempt++ {
+		collection := &Collection{UserID: userID, Title: title}
+		collection.Link, err = shareIDs.Generate(style)
+		if err != nil {
+			return nil, err
+		}
+
+		err = DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(collection).Error; err != nil {
+				return err
+			}
+			items := make([]CollectionUpload, len(uploadIDs))
+			for i, uploadID := range uploadIDs {
+				items[i] = CollectionUpload{CollectionID: collection.ID, UploadID: uploadID, Position: i}
+			}
+			return tx.Create(&items).Error
+		})
+		if err == nil {
+			return collection, nil
+		}
+		if constraint, ok := uniqueViolation(err); !ok || constraint != "idx_collections_link" {
+			return nil, fmt.Errorf("error saving collection: %w", err)
+		}
+	}
+
+	return nil, fmt.Errorf("error saving collection after %d attempts: %w", maxReserveAttempts, err)
+}
+
+// findCollection loads a collection by link with its committed, undeleted
+// uploads in collection order, each with its links.
+func findCollection(link string) (*Collection, error) {
+	var collection Collection
+	if err := DB.Where("link = ?", link).First(&collection).Error; err != nil {
+		return nil, err
+	}
+
+	err := DB.Scopes(committedUploads).
+		Preload("Shares", func(db *gorm.DB) *gorm.DB {
+			return db.Order("id")
+		}).
+		Joins("JOIN collection_uploads ON collection_uploads.upload_id = uploads.id").
+		Where("collection_uploads.collection_id = ?", collection.ID).
+		Order("collection_uploads.position").
+		Find(&collection.Uploads).Error
+	if err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+// collectionUpload returns the upload with uploadID if it belongs to collection.
+func (c *Collection) collectionUpload(uploadID uint) (*Upload, bool) {
+	for i := range c.Uploads {
+		if c.Uploads[i].ID == uploadID {
+			return &c.Uploads[i], true
+		}
+	}
+	return nil, false
+}
+
+// collectionShare returns the link a collection serves upload through: its
+// oldest active link without a password. Collections have no policy of their
+// own, so they give out a file only while one of its links would, and count
+// downloads against that link. nil means the file is unavailable.
+func collectionShare(upload *Upload) *Share {
+	if upload.MissingAt != nil {
+		return nil
+	}
+	for i := range upload.Shares {
+		share := &upload.Shares[i]
+		if shareStatus(*share) == "active" && share.PasswordHash == "" {
+			return share
+		}
+	}
+	return nil
+}
+
+// collectionUploads returns the uploads of collection that collectionShare
+// makes available.
+func collectionUploads(collection *Collection) []Upload {
+	available := make([]Upload, 0, len(collection.Uploads))
+	for i := range collection.Uploads {
+		if collectionShare(&collection.Uploads[i]) != nil {
+			available = append(available, collection.Uploads[i])
+		}
+	}
+	return available
+}
+
+// uploadIDsForShares resolves share links owned by userID to their upload IDs,
+// dropping duplicates but keeping the order the links were given in.
+func uploadIDsForShares(shareIDs []string, userID string) ([]uint, error) {
+	seen := make(map[uint]bool)
+	var uploadIDs []uint
+	for _, shareID := range shareIDs {
+		shareID = strings.TrimSpace(shareID)
+		if shareID == "" {
+			continue
+		}
+		share, err := findOwnedShare(shareID, userID)
+		if err != nil {
+			return nil, fmt.Errorf("share %q not found", shareID)
+		}
+		if !seen[share.UploadID] {
+			seen[share.UploadID] = true
+			uploadIDs = append(uploadIDs, share.UploadID)
+		}
+	}
+	return uploadIDs, nil
+}
+
+// collectionInfo is the JSON representation of a collection.
+type collectionInfo struct {
+	Link      string           `json:"link"`
+	URL       string           `json:"url"`
+	Title     string           `json:"title,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+	TotalSize int64            `json:"total_size"`
+	Files     []collectionFile `json:"files"`
+}
+
+type collectionFile struct {
+	ID            uint   `json:"id"`
+	Filename      string `json:"filename"`
+	FileSize      int64  `json:"file_size"`
+	URL           string `json:"url"`
+	ThumbnailURL  string `json:"thumbnail_url,omitempty"`
+	StoryboardURL string `json:"storyboard_url,omitempty"`
+	Available     bool   `json:"available"`
+}
+
+func toCollectionInfo(collection Collection) collectionInfo {
+	info := collectionInfo{
+		Link:      collection.Link,
+		URL:       collectionURL(collection.Link),
+		Title:     collection.Title,
+		CreatedAt: collection.CreatedAt,
+		Files:     make([]collectionFile, 0, len(collection.Uploads)),
+	}
+	for _, upload := range collection.Uploads {
+		file := collectionFile{
+			ID:        upload.ID,
+			Filename:  upload.Filename,
+			FileSize:  upload.FileSize,
+			URL:       fmt.Sprintf("%s/file/%d", info.URL, upload.ID),
+			Available: collectionShare(&upload) != nil,
+		}
+		if file.Available && canThumbnail(upload) {
+			file.ThumbnailURL = fmt.Sprintf("%s/thumb/%d", info.URL, upload.ID)
+		}
+		if file.Available && upload.StoryboardKey != "" {
+			file.StoryboardURL = fmt.Sprintf("%s/storyboard/%d", info.URL, upload.ID)
+		}
+		info.TotalSize += upload.FileSize
+		info.Files = append(info.Files, file)
+	}
+	return info
+}
+
+// isImageFile reports whether filename looks like an image by its extension.
+func isImageFile(filename string) bool {
+	return strings.HasPrefix(mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))), "image/")
+}
+
+// renderCollectionPage renders the landing page of a collection.
+func renderCollectionPage(collection Collection) string {
+	info := toCollectionInfo(collection)
+
+	title := info.Title
+	if title == "" {
+		title = fmt.Sprintf("%d shared files", len(info.Files))
+	}
+
+	var rows strings.Builder
+	for _, file := range info.Files {
+		icon := `<div style="font-size: 2rem; width: 64px; text-align: center;">📄</div>`
+		preview := icon
+		if file.ThumbnailURL != "" {
+			preview = fmt.Sprintf(`<img src="%s" alt="" loading="lazy" onerror="this.outerHTML=this.dataset.icon" data-icon="%s" style="width: 64px; height: 64px; object-fit: cover; border-radius: 4px;">`, file.ThumbnailURL, html.EscapeString(icon))
+		}
+		if file.StoryboardURL != "" {
+			preview = fmt.Sprintf(`<a href="%s" target="_blank" title="Storyboard">%s</a>`, file.StoryboardURL, preview)
+		}
+
+		action := `<span class="tag is-warning is-light">Unavailable</span>`
+		if file.Available {
+			action = fmt.Sprintf(`<a class="button is-small is-primary is-light" href="%s">⬇️ Download</a>`, file.URL)
+		}
+
+		fmt.Fprintf(&rows, `
+                <div class="box mb-3">
+                    <div class="is-flex is-align-items-center" style="gap: 1rem;">
+                        %s
+                        <div style="flex: 1; min-width: 0;">
+                            <div class="has-text-weight-semibold" style="overflow-wrap: anywhere;">%s</div>
+                            <div class="has-text-grey is-size-7">%s</div>
+                        </div>
+                        %s
+                    </div>
+                </div>`, preview, html.EscapeString(file.Filename), formatBytes(uint64(file.FileSize)), action)
+	}
+
+	return fmt.Sprintf(`<!Doctype html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/bulma@1.0.4/css/bulma.min.css">
+    <title>%s - Supashare</title>
+</head>
+<body>
+    <section class="section">
+        <div class="container" style="max-width: 48rem;">
+            <div class="title is-3">📁 %s</div>
+            <p class="subtitle is-6 has-text-grey">%d files · %s</p>
+            <a class="button is-primary mb-4" href="%s/zip">⬇️ Download all as zip</a>
+            %s
+        </div>
+    </section>
+</body>
+</html>`, html.EscapeString(title), html.EscapeString(title), len(info.Files), formatBytes(uint64(info.TotalSize)), info.URL, rows.String())
+}
+
+// renderCollectionBox renders a collection in the owner's collection list.
+func renderCollectionBox(collection Collection) string {
+	info := toCollectionInfo(collection)
+
+	title := info.Title
+	if title == "" {
+		title = "Untitled collection"
+	}
+
+	return fmt.Sprintf(`
+        <div class="box mb-3">
+            <div class="is-flex is-justify-content-space-between is-align-items-center">
+                <div class="is-flex is-align-items-center" style="gap: 1rem; flex: 1;">
+                    <div style="font-size: 1.5rem;">🗂️</div>
+                    <div style="flex: 1;">
+                        <div class="has-text-weight-semibold">%s</div>
+                        <div class="has-text-grey is-size-7">%d files · %s · <a href="%s">%s</a></div>
+                    </div>
+                </div>
+                <div class="is-flex" style="gap: 0.5rem;">
+                    <button class="button is-small is-primary is-light" onclick="copyLink('%s')">📋 Copy Link</button>
+                    <button class="button is-small is-danger is-light" hx-delete="/c/%s" hx-vals='js:{"user_id": getUserID()}' hx-target="closest .box" hx-swap="outerHTML" hx-confirm="Delete this collection? The files stay shared.">🗑️ Delete</button>
+                </div>
+            </div>
+        </div>
+        `, html.EscapeString(title), len(info.Files), formatBytes(uint64(info.TotalSize)), info.URL, info.URL, info.URL, collection.Link)
+}
+
+// sendCollection answers a request that created a collection.
+func sendCollection(ctx *fiber.Ctx, collection *Collection) error {
+	loaded, err := findCollection(collection.Link)
+	if err != nil {
+		appLogger.WithError(err).WithField("collection", collection.Link).Error("failed to load collection")
+		ctx.Status(fiber.StatusInternalServerError)
+		return ctx.SendString("<p>Error loading collection</p>")
+	}
+
+	if wantsJSON(ctx) {
+		return ctx.JSON(toCollectionInfo(*loaded))
+	}
+	return ctx.SendString(renderCollectionBox(*loaded))
+}
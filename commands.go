@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// commands are the maintenance subcommands of the server binary. Running the
+// binary without arguments starts the server as before.
+var commands = map[string]func(args []string) error{
+	"migrate":     runMigrate,
+	"reconcile":   runReconcile,
+	"purge":       runPurge,
+	"recompute":   runRecompute,
+	"flush-cache": runFlushCache,
+	"reassign":    runReassign,
+}
+
+func runCommand(name string, args []string) error {
+	run, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "Available commands: %v\n", names)
+		return fmt.Errorf("unknown command %q", name)
+	}
+	return run(args)
+}
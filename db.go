@@ -12,14 +12,69 @@ import (
 )
 
 type Upload struct {
-	ID         uint           `gorm:"primaryKey"`
-	UserID     string         `gorm:"index;not null"`
-	Filename   string         `gorm:"not null"`
-	FileKey    string         `gorm:"uniqueIndex;not null"`
-	FileSize   int64          `gorm:"not null"`
-	ShareLink  string         `gorm:"uniqueIndex"`
-	UploadedAt time.Time      `gorm:"autoCreateTime"`
-	DeletedAt  gorm.DeletedAt `gorm:"index"`
+	ID               uint           `gorm:"primaryKey"`
+	UserID           string         `gorm:"index;not null"`
+	Filename         string         `gorm:"not null"`
+	FileKey          string         `gorm:"uniqueIndex;not null"`
+	FileSize         int64          `gorm:"not null"`
+	Checksum         string         // hex SHA-256 of the stored object
+	Status           string         `gorm:"not null;default:committed"`
+	MissingAt        *time.Time     // set by the reconciler when the object is gone from the bucket
+	EntriesIndexedAt *time.Time     // set once an archive upload's entries are recorded
+	LastActiveAt     *time.Time     // refreshed while a pending upload's object is being written
+	ThumbnailKey     string         `gorm:"not null;default:''"` // object key of the JPEG thumbnail; empty until generated
+	StoryboardKey    string         `gorm:"not null;default:''"` // object key of a video's storyboard sprite
+	UploadedAt       time.Time      `gorm:"autoCreateTime"`
+	DeletedAt        gorm.DeletedAt `gorm:"index"`
+	Shares           []Share        // links to this upload, when preloaded
+}
+
+// Share is one link to an upload. Every link has its own access policy, so one
+// recipient's link can be revoked or rotated without touching the others.
+type Share struct {
+	ID           uint    `gorm:"primaryKey"`
+	UploadID     uint    `gorm:"index;not null"`
+	Link         string  `gorm:"uniqueIndex;not null"`
+	Slug         *string `gorm:"uniqueIndex"` // optional vanity alias for Link
+	Label        string  `gorm:"not null;default:''"`
+	PasswordHash string  `gorm:"not null;default:''"` // bcrypt; empty when the link has no password
+	ExpiresAt    *time.Time
+	MaxDownloads *int // nil means unlimited
+	Downloads    int  `gorm:"not null;default:0"`
+	RevokedAt    *time.Time
+	CreatedAt    time.Time
+	Upload       *Upload
+}
+
+// Collection groups uploads under one link whose landing page lists them all.
+type Collection struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    string `gorm:"index;not null"`
+	Link      string `gorm:"uniqueIndex;not null"`
+	Title     string `gorm:"not null;default:''"`
+	CreatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	Uploads   []Upload       `gorm:"-"` // loaded in collection order by findCollection
+}
+
+// CollectionUpload is the join row between a collection and one of its uploads.
+type CollectionUpload struct {
+	CollectionID uint `gorm:"primaryKey"`
+	UploadID     uint `gorm:"primaryKey;index"`
+	Position     int  `gorm:"not null;default:0"`
+}
+
+// ArchiveEntry is one file inside a zip or tar upload, recorded so the
+// archive's contents can be listed and single files served from it.
+type ArchiveEntry struct {
+	ID         uint   `gorm:"primaryKey"`
+	UploadID   uint   `gorm:"not null"`
+	Path       string `gorm:"not null"` // cleaned with archivePath
+	Size       int64  `gorm:"not null"`
+	Mode       uint32 `gorm:"not null;default:0"`
+	Modified   *time.Time
+	DataOffset *int64 // where the entry's data starts in a plain tar; nil for other formats
+	Encrypted  bool   `gorm:"not null;default:false"`
 }
 
 var DB *gorm.DB
@@ -49,3 +104,22 @@ func initDB() error {
 	}).Info("Database connection established")
 	return nil
 }
+
+// runExclusive runs fn while holding the Postgres advisory lock key, skipping it
+// when another replica already holds the lock. It is used by background jobs
+// that every replica schedules but only one should run at a time.
+func runExclusive(key int64, fn func() error) error {
+	return DB.Connection(func(conn *gorm.DB) error {
+		var locked bool
+		if err := conn.Raw("SELECT pg_try_advisory_lock(?)", key).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			appLogger.WithField("lock_key", key).Debug("Job already running on another replica, skipping")
+			return nil
+		}
+		defer conn.Exec("SELECT pg_advisory_unlock(?)", key)
+
+		return fn()
+	})
+}
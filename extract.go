@@ -0,0 +1,232 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Limits on what extractArchive unpacks. Archives over them are refused before
+// anything is stored. The ratio only applies once the unpacked size passes
+// extractRatioFloor, so small archives of text can't trip it.
+const (
+	maxExtractEntries = 1000
+	maxExtractSize    = 10 * 1024 * 1024 * 1024
+	maxExtractRatio   = 100
+	extractRatioFloor = 64 * 1024 * 1024
+)
+
+// errExtractLimit marks archives refused by the extraction limits.
+var errExtractLimit = errors.New("archive exceeds extraction limits")
+
+// checkExtractLimits refuses archives whose listed entries are too many or
+// unpack to too much, in total or relative to the archive's size.
+func checkExtractLimits(upload Upload, entries []ArchiveEntry) error {
+	if len(entries) > maxExtractEntries {
+		return fmt.Errorf("%w: %d files, at most %d can be extracted", errExtractLimit, len(entries), maxExtractEntries)
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	if total > maxExtractSize {
+		return fmt.Errorf("%w: unpacks to %s, at most %s can be extracted", errExtractLimit,
+			formatBytes(uint64(total)), formatBytes(maxExtractSize))
+	}
+	if total > extractRatioFloor && total > maxExtractRatio*max(upload.FileSize, 1) {
+		return fmt.Errorf("%w: unpacks to %s from %s, more than %dx its size", errExtractLimit,
+			formatBytes(uint64(total)), formatBytes(uint64(upload.FileSize)), maxExtractRatio)
+	}
+	return nil
+}
+
+// walkArchive calls fn with each regular file of an archive upload, in archive
+// order. Names are cleaned with archivePath, so fn never sees one that leaves
+// the archive. Symlinks, hard links, devices, encrypted zip entries and repeats
+// of a name are not passed on; skipped counts them.
+func (s *S3Client) walkArchive(upload Upload, fn func(hdr archiveHeader, r io.Reader) error) (skipped int, err error) {
+	seen := make(map[string]bool)
+	wanted := func(name string, regular, dir bool) (string, bool) {
+		if dir {
+			return "", false
+		}
+		name = archivePath(name, "")
+		if !regular || name == "" || seen[name] {
+			skipped++
+			return "", false
+		}
+		seen[name] = true
+		return name, true
+	}
+
+	switch format := archiveFormatOf(upload.Filename); format {
+	case "zip":
+		zr, err := s.openZip(upload)
+		if err != nil {
+			return 0, err
+		}
+		for _, f := range zr.File {
+			name, ok := wanted(f.Name, f.Mode().IsRegular() && f.Flags&0x1 == 0, f.Mode().IsDir())
+			if !ok {
+				continue
+			}
+
+			rc, err := s.openZipFile(upload, f)
+			if err != nil {
+				return skipped, err
+			}
+			err = fn(archiveHeader{Name: name, Size: int64(f.UncompressedSize64), Mode: f.Mode().Perm(), Modified: f.Modified}, rc)
+			rc.Close()
+			if err != nil {
+				return skipped, err
+			}
+		}
+		return skipped, nil
+	case "tar", "tar.gz", "tar.zst":
+		tr, closer, err := s.openTar(upload, format)
+		if err != nil {
+			return 0, err
+		}
+		defer closer.Close()
+
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return skipped, nil
+			}
+			if err != nil {
+				return skipped, err
+			}
+
+			name, ok := wanted(hdr.Name, hdr.Typeflag == tar.TypeReg, hdr.Typeflag == tar.TypeDir)
+			if !ok {
+				continue
+			}
+			if err := fn(archiveHeader{Name: name, Size: hdr.Size, Mode: hdr.FileInfo().Mode().Perm(), Modified: hdr.ModTime}, tr); err != nil {
+				return skipped, err
+			}
+		}
+	}
+	return 0, fmt.Errorf("%s is not a supported archive", upload.Filename)
+}
+
+// copyEntry copies exactly size bytes of an entry from r to w. Entries that
+// turn out bigger than their header says are refused, which keeps a forged
+// size from getting past checkExtractLimits.
+func copyEntry(w io.Writer, r io.Reader, size int64) error {
+	_, err := io.Copy(w, newEntryReader(r, size))
+	return err
+}
+
+// entryReader reads an archive entry whose header says it is size bytes,
+// failing instead of ending early or running over when it isn't. Headers are
+// whatever the uploader wrote, so they can't be trusted to match the data.
+type entryReader struct {
+	r         io.Reader
+	size      int64
+	remaining int64
+}
+
+func newEntryReader(r io.Reader, size int64) *entryReader {
+	return &entryReader{r: r, size: size, remaining: size}
+}
+
+func (e *entryReader) Read(p []byte) (int, error) {
+	if e.remaining <= 0 {
+		var probe [1]byte
+		_, err := io.ReadFull(e.r, probe[:])
+		switch err {
+		case nil:
+			return 0, fmt.Errorf("%w: an entry is larger than its header says", errExtractLimit)
+		case io.EOF:
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	if err == io.EOF && e.remaining > 0 {
+		return n, fmt.Errorf("entry is truncated: got %d of %d bytes", e.size-e.remaining, e.size)
+	}
+	if err == io.EOF {
+		err = nil // the probe above decides
+	}
+	return n, err
+}
+
+// extractArchive stores every regular file of an archive upload as an upload
+// of its own for userID, each with a first link following opts. Files are
+// named after their base name, with " (2)" and so on added where those clash.
+// Either every file is extracted or, on error, the ones stored so far are
+// deleted again, objects and previews included. It also returns how many
+// entries walkArchive skipped.
+func (s *S3Client) extractArchive(upload *Upload, userID string, opts UploadOptions) ([]Upload, int, error) {
+	start := time.Now()
+
+	entries, err := s.archiveEntries(upload)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkExtractLimits(*upload, entries); err != nil {
+		return nil, 0, err
+	}
+
+	paths := make([]string, len(entries))
+	for i, entry := range entries {
+		paths[i] = path.Base(entry.Path)
+	}
+	filenames := make(map[string]string, len(entries))
+	for i, name := range uniqueNames(paths) {
+		filenames[entries[i].Path] = name
+	}
+
+	var extracted []Upload
+	skipped, err := s.walkArchive(*upload, func(hdr archiveHeader, r io.Reader) error {
+		filename, ok := filenames[hdr.Name]
+		if !ok {
+			// The index caps how many entries it records; anything past it
+			// was already refused by checkExtractLimits.
+			return fmt.Errorf("%w: %s is not in the archive's index", errExtractLimit, hdr.Name)
+		}
+
+		stored, err := s.UploadStream(userID, filename, opts, func(w io.Writer) error {
+			if !opts.StripMetadata {
+				return copyEntry(w, r, hdr.Size)
+			}
+			src, _, err := stripMetadataReader(filename, newEntryReader(r, hdr.Size))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, src)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		extracted = append(extracted, *stored)
+		return nil
+	})
+	if err != nil {
+		s.removeUploads(extracted)
+		return nil, skipped, err
+	}
+
+	appLogger.WithFields(logrus.Fields{
+		"upload_id":   upload.ID,
+		"user_id":     userID,
+		"file_count":  len(extracted),
+		"skipped":     skipped,
+		"duration_ms": time.Since(start).Milliseconds(),
+	}).Info("archive extracted")
+	return extracted, skipped, nil
+}
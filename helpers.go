@@ -1,17 +1,18 @@
 package main
 
 import (
-	"archive/zip"
 	"bytes"
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
-	"image/jpeg"
+	"html"
+	"image/gif"
 	"io"
 	"mime/multipart"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,6 +22,7 @@ import (
 	"github.com/shirou/gopsutil/v3/host"
 	"github.com/shirou/gopsutil/v3/mem"
 	"github.com/shirou/gopsutil/v3/process"
+	"gorm.io/gorm"
 )
 
 func formatBytes(bytes uint64) string {
@@ -53,7 +55,9 @@ func getUploads(ctx *fiber.Ctx) ([]Upload, error) {
 	}
 	var uploads []Upload
 
-	if err := DB.Where("user_id = ?", userId).Order("uploaded_at DESC").Find(&uploads).Error; err != nil {
+	if err := DB.Scopes(committedUploads).Where("user_id = ?", userId).
+		Preload("Shares", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Order("uploaded_at DESC").Find(&uploads).Error; err != nil {
 		appLogger.WithField("user_id", userId).WithError(err).Error("Database error retrieving uploads")
 		ctx.Status(fiber.StatusInternalServerError)
 		ctx.SendString("<p>Error retrieving uploads</p>")
@@ -63,50 +67,330 @@ func getUploads(ctx *fiber.Ctx) ([]Upload, error) {
 	return uploads, nil
 }
 
-func generateShareLink() string {
-	bytes := make([]byte, 6)
+// shareInfo is the JSON representation of an upload returned to API clients.
+// ShareLink, URL and ExpiresAt describe the upload's primary link; Links has
+// all of them.
+type shareInfo struct {
+	ShareLink  string     `json:"share_link"`
+	URL        string     `json:"url"`
+	Slug       string     `json:"slug,omitempty"`
+	VanityURL  string     `json:"vanity_url,omitempty"`
+	Filename   string     `json:"filename"`
+	FileSize   int64      `json:"file_size"`
+	UploadedAt time.Time  `json:"uploaded_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	EntriesURL string     `json:"entries_url,omitempty"`
+	// ThumbnailURL and StoryboardURL follow the policy of the primary link.
+	ThumbnailURL  string     `json:"thumbnail_url,omitempty"`
+	StoryboardURL string     `json:"storyboard_url,omitempty"`
+	Links         []linkInfo `json:"links"`
+}
+
+// linkInfo is the JSON representation of one share link.
+type linkInfo struct {
+	Link         string     `json:"link"`
+	URL          string     `json:"url"`
+	Slug         string     `json:"slug,omitempty"`
+	VanityURL    string     `json:"vanity_url,omitempty"`
+	Label        string     `json:"label,omitempty"`
+	Password     bool       `json:"password"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads *int       `json:"max_downloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	Status       string     `json:"status"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
 
-	if _, err := rand.Read(bytes); err != nil {
-		return fmt.Sprintf("%d", time.Now().Unix()) // fallback to unix timestamp
+func toShareInfo(upload Upload) shareInfo {
+	info := shareInfo{
+		Filename:   upload.Filename,
+		FileSize:   upload.FileSize,
+		UploadedAt: upload.UploadedAt,
+		Links:      make([]linkInfo, 0, len(upload.Shares)),
+	}
+	for _, share := range upload.Shares {
+		info.Links = append(info.Links, toLinkInfo(share))
+	}
+	if primary := primaryShare(upload); primary != nil {
+		link := toLinkInfo(*primary)
+		info.ShareLink = link.Link
+		info.URL = link.URL
+		info.Slug = link.Slug
+		info.VanityURL = link.VanityURL
+		info.ExpiresAt = link.ExpiresAt
+		if archiveFormatOf(upload.Filename) != "" {
+			info.EntriesURL = link.URL + "/entries"
+		}
+		if canThumbnail(upload) {
+			info.ThumbnailURL = link.URL + "/thumb"
+		}
+		if upload.StoryboardKey != "" {
+			info.StoryboardURL = link.URL + "/storyboard"
+		}
 	}
+	return info
+}
 
-	return base64.URLEncoding.EncodeToString(bytes)[:8]
+func toLinkInfo(share Share) linkInfo {
+	info := linkInfo{
+		Link:         share.Link,
+		URL:          shareURL(share.Link),
+		Label:        share.Label,
+		Password:     share.PasswordHash != "",
+		ExpiresAt:    share.ExpiresAt,
+		MaxDownloads: share.MaxDownloads,
+		Downloads:    share.Downloads,
+		Status:       shareStatus(share),
+		RevokedAt:    share.RevokedAt,
+		CreatedAt:    share.CreatedAt,
+	}
+	if share.Slug != nil {
+		info.Slug = *share.Slug
+		info.VanityURL = shareURL(*share.Slug)
+	}
+	return info
 }
 
-func createZip(files []*multipart.FileHeader) (*bytes.Buffer, error) {
-	start := time.Now()
-	appLogger.WithField("file_count", len(files)).Info("Creating zip archive")
-	buf := new(bytes.Buffer)
-	zipper := zip.NewWriter(buf)
+// renderShareBox renders one upload as a box in the /my-shares list, with a row
+// per link and a form for adding another. Links with a slug show and copy the
+// vanity URL instead of the random link.
+func renderShareBox(upload Upload) string {
+	var sb strings.Builder
 
-	for _, file := range files {
-		fileReader, err := file.Open()
-		if err != nil {
-			appLogger.WithField("filename", file.Filename).WithError(err).Error("Failed to open file for zipping")
-			return nil, fmt.Errorf("Failed to open file %s: %w", file.Filename, err)
+	deleteID := ""
+	if primary := primaryShare(upload); primary != nil {
+		deleteID = primary.Link
+	}
+
+	contents := ""
+	if archiveFormatOf(upload.Filename) != "" && deleteID != "" {
+		contents = fmt.Sprintf(`
+                    <a class="button is-small is-light" href="/share/%s/entries" target="_blank">📦 Contents</a>
+                    <button class="button is-small is-light" onclick="extractArchive('%s')">📂 Extract</button>`, deleteID, deleteID)
+	}
+
+	// Previews are generated after upload, so a new file may not have its
+	// thumbnail yet; the icon stands in until it does.
+	preview := "📄"
+	if canThumbnail(upload) && deleteID != "" {
+		src := fmt.Sprintf("/share/%s/thumb?user_id=%s", deleteID, url.QueryEscape(upload.UserID))
+		preview = fmt.Sprintf(`<img src="%s" alt="" loading="lazy" onerror="this.outerHTML='📄'" style="width: 48px; height: 48px; object-fit: cover; border-radius: 4px; display: block;">`, html.EscapeString(src))
+		if upload.StoryboardKey != "" {
+			storyboard := fmt.Sprintf("/share/%s/storyboard?user_id=%s", deleteID, url.QueryEscape(upload.UserID))
+			preview = fmt.Sprintf(`<a href="%s" target="_blank" title="Storyboard">%s</a>`, html.EscapeString(storyboard), preview)
 		}
-		defer fileReader.Close()
+	}
 
-		zipFile, err := zipper.Create(file.Filename)
-		if err != nil {
-			appLogger.WithField("filename", file.Filename).WithError(err).Error("Failed to create zip entry")
-			return nil, fmt.Errorf("Failed to create zip for %s: %w", file.Filename, err)
+	fmt.Fprintf(&sb, `
+        <div class="box mb-3">
+            <div class="is-flex is-justify-content-space-between is-align-items-center">
+                <div class="is-flex is-align-items-center" style="gap: 1rem; flex: 1;">
+                    <input type="checkbox" name="share_ids" value="%s" form="collection-form" title="Select for a collection or zip download">
+                    <div style="font-size: 1.5rem;">%s</div>
+                    <div style="flex: 1;">
+                        <div class="has-text-weight-semibold">%s</div>
+                        <div class="has-text-grey is-size-7">%s</div>
+                    </div>
+                </div>
+                <div class="is-flex" style="gap: 0.5rem;">%s
+                    <button class="button is-small is-danger is-light" hx-delete="/share/%s" hx-vals='js:{"user_id": getUserID()}' hx-target="closest .box" hx-swap="outerHTML" hx-confirm="Delete %s and all of its links?">
+                        <span class="icon is-small">
+                            <span>🗑️</span>
+                        </span>
+                        <span>Delete</span>
+                    </button>
+                </div>
+            </div>
+        `, deleteID, preview, html.EscapeString(upload.Filename), formatBytes(uint64(upload.FileSize)), contents, deleteID, html.EscapeString(upload.Filename))
+
+	for _, share := range upload.Shares {
+		sb.WriteString(renderLinkRow(toLinkInfo(share)))
+	}
+
+	fmt.Fprintf(&sb, `
+            <form class="field is-grouped is-grouped-multiline mt-3" hx-post="/share/%s/links" hx-vals='js:{"user_id": getUserID()}' hx-target="closest .box" hx-swap="outerHTML">
+                <div class="control"><input class="input is-small" type="text" name="label" placeholder="Label, e.g. for ACME legal"></div>
+                <div class="control"><input class="input is-small" type="text" name="expire" placeholder="Expires in (7d)" style="width: 8rem;"></div>
+                <div class="control"><input class="input is-small" type="password" name="password" placeholder="Password" style="width: 8rem;"></div>
+                <div class="control"><input class="input is-small" type="number" min="1" name="max_downloads" placeholder="Max downloads" style="width: 8rem;"></div>
+                <div class="control"><button class="button is-small is-primary is-light" type="submit">New Link</button></div>
+            </form>
+        </div>
+        `, deleteID)
+
+	return sb.String()
+}
+
+// renderLinkRow renders one link inside a share box.
+func renderLinkRow(link linkInfo) string {
+	url := link.URL
+	if link.VanityURL != "" {
+		url = link.VanityURL
+	}
+
+	var details []string
+	if link.Label != "" {
+		details = append(details, "<strong>"+html.EscapeString(link.Label)+"</strong>")
+	}
+	if link.Status != "active" {
+		details = append(details, `<span class="tag is-warning is-light">`+link.Status+`</span>`)
+	}
+	if link.Password {
+		details = append(details, "🔒 password")
+	}
+	if link.ExpiresAt != nil {
+		details = append(details, "expires "+link.ExpiresAt.Format("2006-01-02 15:04"))
+	}
+	if link.MaxDownloads != nil {
+		details = append(details, fmt.Sprintf("%d/%d downloads", link.Downloads, *link.MaxDownloads))
+	} else {
+		details = append(details, fmt.Sprintf("%d downloads", link.Downloads))
+	}
+
+	actions := ""
+	if link.Status != "revoked" {
+		actions = fmt.Sprintf(`
+                    <button class="button is-small is-primary is-light" onclick="copyLink('%s')">📋 Copy</button>
+                    <button class="button is-small is-light" hx-post="/share/%s/rotate" hx-vals='js:{"user_id": getUserID()}' hx-target="closest .box" hx-swap="outerHTML" hx-confirm="Replace this link? The current URL will stop working.">🔄 Rotate</button>
+                    <button class="button is-small is-warning is-light" hx-post="/share/%s/revoke" hx-vals='js:{"user_id": getUserID()}' hx-target="closest .box" hx-swap="outerHTML" hx-confirm="Revoke this link?">⛔ Revoke</button>`,
+			url, link.Link, link.Link)
+	}
+
+	slugForm := ""
+	if link.Status != "revoked" {
+		slugForm = fmt.Sprintf(`
+                <form class="field has-addons mt-1" hx-put="/share/%s/slug" hx-vals='js:{"user_id": getUserID()}' hx-target="closest .box" hx-swap="outerHTML">
+                    <div class="control is-expanded">
+                        <input class="input is-small" type="text" name="slug" value="%s" placeholder="custom-link (leave empty to remove)">
+                    </div>
+                    <div class="control">
+                        <button class="button is-small" type="submit">Set Link</button>
+                    </div>
+                </form>`, link.Link, link.Slug)
+	}
+
+	return fmt.Sprintf(`
+            <div class="mt-3 pt-2" style="border-top: 1px solid #eee;">
+                <div class="is-flex is-justify-content-space-between is-align-items-center" style="gap: 0.5rem;">
+                    <div class="is-size-7" style="flex: 1;">
+                        <div><a href="%s">%s</a></div>
+                        <div class="has-text-grey">%s</div>
+                    </div>
+                    <div class="is-flex" style="gap: 0.5rem;">%s
+                    </div>
+                </div>%s
+            </div>
+        `, url, url, strings.Join(details, " · "), actions, slugForm)
+}
+
+func shareURL(shareLink string) string {
+	return fmt.Sprintf("%sshare/%s", URL, shareLink)
+}
+
+// UploadOptions are the settings clients can pass with any upload. Apart from
+// ShareIDStyle they set the policy of the upload's first link, and the same
+// form values configure links added later.
+type UploadOptions struct {
+	ExpiresAt    *time.Time
+	ShareIDStyle ShareIDStyle
+	Label        string
+	Password     string
+	MaxDownloads *int
+	// StripMetadata removes identifying metadata before the file is stored;
+	// see stripMetadata.
+	StripMetadata bool
+}
+
+// uploadOptionsFromForm reads the "expire", "link_style", "label", "password",
+// "max_downloads" and "strip_metadata" form values. STRIP_METADATA=true turns
+// stripping on for every upload.
+func uploadOptionsFromForm(ctx *fiber.Ctx) (UploadOptions, error) {
+	expiresAt, err := parseExpiry(ctx.FormValue("expire"))
+	if err != nil {
+		return UploadOptions{}, err
+	}
+
+	style, err := parseShareIDStyle(ctx.FormValue("link_style"))
+	if err != nil {
+		return UploadOptions{}, err
+	}
+
+	maxDownloads, err := parseMaxDownloads(ctx.FormValue("max_downloads"))
+	if err != nil {
+		return UploadOptions{}, err
+	}
+
+	return UploadOptions{
+		ExpiresAt:     expiresAt,
+		ShareIDStyle:  style,
+		Label:         strings.TrimSpace(ctx.FormValue("label")),
+		Password:      ctx.FormValue("password"),
+		MaxDownloads:  maxDownloads,
+		StripMetadata: ctx.FormValue("strip_metadata") == "true" || stripMetadataByDefault(),
+	}, nil
+}
+
+// formValues returns every value of a form field that may repeat, such as a
+// list of checkboxes, from a multipart or urlencoded body or the query string.
+func formValues(ctx *fiber.Ctx, key string) []string {
+	if form, err := ctx.MultipartForm(); err == nil {
+		if values := form.Value[key]; len(values) > 0 {
+			return values
+		}
+	}
+
+	var values []string
+	for _, value := range ctx.Request().PostArgs().PeekMulti(key) {
+		values = append(values, string(value))
+	}
+	if len(values) == 0 {
+		for _, value := range ctx.Request().URI().QueryArgs().PeekMulti(key) {
+			values = append(values, string(value))
 		}
+	}
+	return values
+}
+
+// wantsJSON reports whether the client asked for JSON instead of the HTMX fragments
+// the web interface uses. Browsers and htmx send */* so they keep getting HTML.
+func wantsJSON(ctx *fiber.Ctx) bool {
+	return ctx.Accepts(fiber.MIMETextHTML, fiber.MIMEApplicationJSON) == fiber.MIMEApplicationJSON
+}
+
+// parseExpiry parses an expiry such as "7d", "2w" or any time.ParseDuration value
+// into an absolute time. An empty string means the share never expires.
+func parseExpiry(expire string) (*time.Time, error) {
+	expire = strings.TrimSpace(expire)
+	if expire == "" {
+		return nil, nil
+	}
 
-		_, err = io.Copy(zipFile, fileReader)
+	var duration time.Duration
+	switch unit := expire[len(expire)-1]; unit {
+	case 'd', 'w':
+		n, err := strconv.Atoi(expire[:len(expire)-1])
 		if err != nil {
-			appLogger.WithField("filename", file.Filename).WithError(err).Error("Failed to add file to zip")
-			return nil, fmt.Errorf("Failed to add file %s to zip: %w", file.Filename, err)
+			return nil, fmt.Errorf("invalid expiry %q: %w", expire, err)
 		}
+		duration = time.Duration(n) * 24 * time.Hour
+		if unit == 'w' {
+			duration *= 7
+		}
+	default:
+		d, err := time.ParseDuration(expire)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry %q: %w", expire, err)
+		}
+		duration = d
 	}
 
-	if err := zipper.Close(); err != nil {
-		appLogger.WithError(err).Error("Failed to finalize zip archive")
-		return nil, fmt.Errorf("Failed to finalize zip: %w", err)
+	if duration <= 0 {
+		return nil, fmt.Errorf("invalid expiry %q: must be positive", expire)
 	}
 
-	appLogger.WithField("output_size", buf.Len()).WithField("duration_ms", time.Since(start).Milliseconds()).Info("Zip archive created successfully")
-	return buf, nil
+	expiresAt := time.Now().Add(duration)
+	return &expiresAt, nil
 }
 
 func getSystemStats() (fiber.Map, error) {
@@ -195,7 +479,10 @@ func getCompressionQuality(qualityStr string) CompressionQuality {
 	}
 }
 
-func compressImage(file *multipart.FileHeader, quality CompressionQuality) (*bytes.Buffer, error) {
+// compressImage downscales an image for quality and re-encodes it as opts ask,
+// returning the format it was saved in; see outputFormat. Transparency is kept
+// except in JPEGs, where it is flattened onto opts.Background.
+func compressImage(file *multipart.FileHeader, quality CompressionQuality, opts ImageOptions) (*bytes.Buffer, ImageFormat, error) {
 	start := time.Now()
 	originalSize := file.Size
 	appLogger.WithField("filename", file.Filename).WithField("quality", quality).Info("Starting image compression")
@@ -203,14 +490,50 @@ func compressImage(file *multipart.FileHeader, quality CompressionQuality) (*byt
 	srcFile, err := file.Open()
 	if err != nil {
 		appLogger.WithField("filename", file.Filename).WithError(err).Error("Failed to open image file")
-		return nil, fmt.Errorf("Failed to open image file: %w", err)
+		return nil, "", fmt.Errorf("Failed to open image file: %w", err)
 	}
 	defer srcFile.Close()
 
-	img, err := imaging.Decode(srcFile)
+	// imaging.Decode would keep only the first frame of an animated GIF.
+	if config, frames, err := scanGIF(srcFile); err == nil && frames > 1 {
+		if int64(config.Width)*int64(config.Height)*int64(frames) > maxAnimatedGIFPixels {
+			appLogger.WithField("filename", file.Filename).
+				WithField("dimensions", fmt.Sprintf("%dx%d", config.Width, config.Height)).
+				WithField("frames", frames).
+				Warn("Animated GIF too large to compress")
+			return nil, "", fmt.Errorf("animated GIF is too large: %dx%d with %d frames", config.Width, config.Height, frames)
+		}
+		if _, err := srcFile.Seek(0, io.SeekStart); err != nil {
+			return nil, "", fmt.Errorf("Failed to read image file: %w", err)
+		}
+		g, err := gif.DecodeAll(srcFile)
+		if err != nil {
+			appLogger.WithField("filename", file.Filename).WithError(err).Error("Failed to decode animated GIF")
+			return nil, "", fmt.Errorf("failed to decode animated GIF: %w", err)
+		}
+		buf := new(bytes.Buffer)
+		if err := compressAnimatedGIF(buf, g, quality); err != nil {
+			appLogger.WithField("filename", file.Filename).WithError(err).Error("Failed to encode animated GIF")
+			return nil, "", fmt.Errorf("failed to encode animated GIF: %w", err)
+		}
+		appLogger.WithField("filename", file.Filename).
+			WithField("original_size", originalSize).
+			WithField("compressed_size", buf.Len()).
+			WithField("frames", len(g.Image)).
+			WithField("duration_ms", time.Since(start).Milliseconds()).
+			Info("Animated GIF compression completed successfully")
+		return buf, ImageFormatGIF, nil
+	}
+	if _, err := srcFile.Seek(0, io.SeekStart); err != nil {
+		return nil, "", fmt.Errorf("Failed to read image file: %w", err)
+	}
+
+	// Phone photos are stored sideways with an EXIF orientation, which the
+	// re-encoded image wouldn't carry, so it is applied to the pixels instead.
+	img, err := imaging.Decode(srcFile, imaging.AutoOrientation(true))
 	if err != nil {
 		appLogger.WithField("filename", file.Filename).WithError(err).Error("Failed to decode image")
-		return nil, fmt.Errorf("Failed to decode image: %w", err)
+		return nil, "", fmt.Errorf("Failed to decode image: %w", err)
 	}
 
 	bounds := img.Bounds()
@@ -234,35 +557,16 @@ func compressImage(file *multipart.FileHeader, quality CompressionQuality) (*byt
 
 	buf := new(bytes.Buffer)
 
-	ext := strings.ToLower(filepath.Ext(file.Filename))
-
-	if ext == ".png" {
-		// lossless compression, convert to jpeg for better compression
-		jpegQuality := 85
-		switch quality {
-		case QualityMedium:
-			jpegQuality = 75
-		case QualityLow:
-			jpegQuality = 60
-		}
-
-		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: jpegQuality})
-	} else {
-		// JPEG compression
-		jpegQuality := 90
-		switch quality {
-		case QualityMedium:
-			jpegQuality = 80
-		case QualityLow:
-			jpegQuality = 65
-		}
-
-		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: jpegQuality})
+	transparent := hasTransparency(img)
+	format := outputFormat(file.Filename, opts.Format, transparent)
+	if transparent && format == ImageFormatJPEG {
+		img = flatten(img, opts.Background)
 	}
 
+	err = encodeImage(buf, img, file.Filename, format, quality)
 	if err != nil {
 		appLogger.WithField("filename", file.Filename).WithError(err).Error("Failed to encode image")
-		return nil, fmt.Errorf("failed to encode image: %w", err)
+		return nil, "", fmt.Errorf("failed to encode image: %w", err)
 	}
 
 	compressedSize := int64(buf.Len())
@@ -271,26 +575,55 @@ func compressImage(file *multipart.FileHeader, quality CompressionQuality) (*byt
 		WithField("original_size", originalSize).
 		WithField("compressed_size", compressedSize).
 		WithField("reduction_percent", reduction).
+		WithField("format", format).
 		WithField("duration_ms", time.Since(start).Milliseconds()).
 		Info("Image compression completed successfully")
 
-	return buf, nil
+	return buf, format, nil
+}
+
+// compressedVideo is the output of compressVideo, a temporary file that Close
+// removes again.
+type compressedVideo struct {
+	*os.File
+	Size int64
+	dir  string
 }
 
-func compressVideo(file *multipart.FileHeader, quality CompressionQuality) (*bytes.Buffer, error) {
+func (v *compressedVideo) Close() error {
+	v.File.Close()
+	return os.RemoveAll(v.dir)
+}
+
+// compressVideo re-encodes a video, or an animated GIF, at quality as
+// container: H.264 and AAC in "mp4", or VP9 and Opus in "webm". With
+// stripMetadata it leaves out tags, chapters and metadata tracks as
+// stripVideoMetadata would.
+//
+// Both the input and output are temporary files rather than pipes: MP4 and
+// MOV files often keep their index at the end, which ffmpeg can only reach by
+// seeking, and +faststart moves it to the front of the output the same way.
+// Nothing is held in memory, whatever the size of the video.
+func compressVideo(file *multipart.FileHeader, quality CompressionQuality, container string, stripMetadata bool) (_ *compressedVideo, err error) {
 	start := time.Now()
 	originalSize := file.Size
 	appLogger.WithField("filename", file.Filename).WithField("quality", quality).Info("Starting video compression")
 
-	srcFile, err := file.Open()
+	dir, err := os.MkdirTemp("", "supashare-video-")
 	if err != nil {
-		appLogger.WithField("filename", file.Filename).WithError(err).Error("Failed to open video file")
-		return nil, fmt.Errorf("Failed to open video file: %w", err)
+		appLogger.WithField("filename", file.Filename).WithError(err).Error("Failed to create temporary directory")
+		return nil, fmt.Errorf("Failed to create temporary directory: %w", err)
 	}
-	defer srcFile.Close()
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
 
-	inputBuf := new(bytes.Buffer)
-	if _, err := inputBuf.ReadFrom(srcFile); err != nil {
+	// The input keeps its extension, which helps ffmpeg tell some formats apart.
+	ext := strings.ToLower(filepath.Ext(file.Filename))
+	input := filepath.Join(dir, "input"+ext)
+	if err := saveFormFile(file, input); err != nil {
 		appLogger.WithField("filename", file.Filename).WithError(err).Error("Failed to read video file")
 		return nil, fmt.Errorf("Failed to read video file: %w", err)
 	}
@@ -302,31 +635,55 @@ func compressVideo(file *multipart.FileHeader, quality CompressionQuality) (*byt
 	case QualityLow:
 		crf = "32"
 	}
+	if container == "webm" {
+		// VP9's scale runs higher than H.264's for the same quality.
+		crf = map[CompressionQuality]string{QualityHigh: "31", QualityMedium: "36", QualityLow: "41"}[quality]
+	}
 
 	appLogger.WithField("filename", file.Filename).WithField("crf", crf).Debug("FFmpeg compression settings")
 
-	outputBuf := new(bytes.Buffer)
-
-	inputFormat := getVideoFormat(file.Filename)
-
-	// Create ffmpeg command
-	cmd := exec.Command("ffmpeg",
-		"-f", inputFormat,
-		"-i", "pipe:0", // input from stdin
-		"-c:v", "libx264",
-		"-crf", crf,
-		"-preset", "medium",
-		"-c:a", "aac",
-		"-b:a", "128k",
-		"-movflags", "+faststart",
-		"-f", "mp4",
-		"pipe:1", // output to stdout
-	)
+	args := []string{"-i", input}
+	if ext == ".gif" {
+		// GIFs are RGB and may have odd dimensions, and H.264 and VP9 players
+		// expect 4:2:0 video with even ones.
+		args = append(args, "-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2", "-pix_fmt", "yuv420p")
+	}
+	if stripMetadata {
+		args = append(args,
+			"-map", "0:v:0",
+			"-map", "0:a:0?",
+			"-map_metadata", "-1",
+			"-map_chapters", "-1",
+			"-fflags", "+bitexact",
+		)
+	}
+	if container == "webm" {
+		args = append(args,
+			"-c:v", "libvpx-vp9",
+			"-crf", crf,
+			"-b:v", "0",
+			"-c:a", "libopus",
+			"-b:a", "96k",
+			"-f", "webm",
+		)
+	} else {
+		args = append(args,
+			"-c:v", "libx264",
+			"-crf", crf,
+			"-preset", "medium",
+			"-c:a", "aac",
+			"-b:a", "128k",
+			"-movflags", "+faststart",
+			"-f", "mp4",
+		)
+	}
+	output := filepath.Join(dir, "output."+container)
+	args = append(args, "-y", output)
+
+	cmd := exec.Command("ffmpeg", args...)
 
 	appLogger.WithField("filename", file.Filename).WithField("operation", "ffmpeg").Debug("Executing FFmpeg command")
 
-	cmd.Stdin = bytes.NewReader(inputBuf.Bytes())
-	cmd.Stdout = outputBuf
 	cmd.Stderr = os.Stderr
 
 	err = cmd.Run()
@@ -335,7 +692,20 @@ func compressVideo(file *multipart.FileHeader, quality CompressionQuality) (*byt
 		return nil, fmt.Errorf("Failed to compress video: %w", err)
 	}
 
-	compressedSize := int64(outputBuf.Len())
+	// The input isn't needed any more, and may be large.
+	os.Remove(input)
+
+	result, err := os.Open(output)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open compressed video: %w", err)
+	}
+	info, err := result.Stat()
+	if err != nil {
+		result.Close()
+		return nil, fmt.Errorf("Failed to open compressed video: %w", err)
+	}
+
+	compressedSize := info.Size()
 	reduction := float64(originalSize-compressedSize) / float64(originalSize) * 100
 	appLogger.WithField("filename", file.Filename).
 		WithField("original_size", originalSize).
@@ -344,38 +714,37 @@ func compressVideo(file *multipart.FileHeader, quality CompressionQuality) (*byt
 		WithField("duration_ms", time.Since(start).Milliseconds()).
 		Info("Video compression completed successfully")
 
-	return outputBuf, nil
+	return &compressedVideo{File: result, Size: compressedSize, dir: dir}, nil
 }
 
-func getVideoFormat(filename string) string {
-	ext := strings.ToLower(filepath.Ext(filename))
-	switch ext {
-	case ".mp4":
-		return "mp4"
-	case ".mov":
-		return "mov"
-	case ".avi":
-		return "avi"
-	case ".mkv":
-		return "matroska"
-	case ".webm":
-		return "webm"
-	default:
-		return "mp4"
+// saveFormFile copies an uploaded file to path.
+func saveFormFile(file *multipart.FileHeader, path string) error {
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
 	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
 }
 
-func getCompressedFileName(original string, isVideo bool) string {
+// getCompressedFileName names the compressed copy of original. It keeps its
+// extension if that is one of exts, the extensions of the format it was saved
+// in, and otherwise gets the first of them. Nil exts keeps the extension.
+func getCompressedFileName(original string, exts []string) string {
 	ext := filepath.Ext(original)
 	name := strings.TrimSuffix(original, ext)
 
-	if isVideo {
-		return fmt.Sprintf("%s_compressed%s", name, ext)
-	}
-
-	// Convert PNGs to JPEG for better compression
-	if strings.ToLower(ext) == ".png" {
-		return fmt.Sprintf("%s_compressed.jpg", name)
+	if len(exts) > 0 && !slices.Contains(exts, strings.ToLower(ext)) {
+		ext = exts[0]
 	}
 
 	return fmt.Sprintf("%s_compressed%s", name, ext)
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/gofiber/fiber/v2"
+	_ "golang.org/x/image/webp" // lets imaging.Decode read WebP
+)
+
+// ImageFormat is the output format /compress-media re-encodes images to.
+type ImageFormat string
+
+const (
+	// ImageFormatAuto picks JPEG, or PNG for images with transparency.
+	ImageFormatAuto ImageFormat = "auto"
+	ImageFormatJPEG ImageFormat = "jpeg"
+	ImageFormatPNG  ImageFormat = "png"
+	ImageFormatWebP ImageFormat = "webp"
+	// ImageFormatOriginal keeps each image in the format it was uploaded in,
+	// which may also be one of the formats below.
+	ImageFormatOriginal ImageFormat = "original"
+	ImageFormatGIF      ImageFormat = "gif"
+	ImageFormatBMP      ImageFormat = "bmp"
+	ImageFormatTIFF     ImageFormat = "tiff"
+)
+
+// imageExtensions are the extensions of each format. Compressed images keep
+// their extension when it matches their format and otherwise get the first.
+var imageExtensions = map[ImageFormat][]string{
+	ImageFormatJPEG: {".jpg", ".jpeg"},
+	ImageFormatPNG:  {".png"},
+	ImageFormatWebP: {".webp"},
+	ImageFormatGIF:  {".gif"},
+	ImageFormatBMP:  {".bmp"},
+	ImageFormatTIFF: {".tif", ".tiff"},
+}
+
+// imagingFormats are the formats encodeImage leaves to imaging.
+var imagingFormats = map[ImageFormat]imaging.Format{
+	ImageFormatGIF:  imaging.GIF,
+	ImageFormatBMP:  imaging.BMP,
+	ImageFormatTIFF: imaging.TIFF,
+}
+
+// ImageOptions are the image settings accepted by /compress-media.
+type ImageOptions struct {
+	Format ImageFormat
+	// Background is what transparent areas are flattened onto when an image
+	// with transparency is saved as JPEG.
+	Background color.NRGBA
+	// Animation is what animated GIFs become; Format only applies to stills.
+	Animation AnimationFormat
+}
+
+// imageOptionsFromForm reads "format", "background" and "animation" from the
+// request.
+func imageOptionsFromForm(ctx *fiber.Ctx) (ImageOptions, error) {
+	format, err := parseImageFormat(ctx.FormValue("format"))
+	if err != nil {
+		return ImageOptions{}, err
+	}
+	background, err := parseHexColor(ctx.FormValue("background"))
+	if err != nil {
+		return ImageOptions{}, err
+	}
+	animation, err := parseAnimationFormat(ctx.FormValue("animation"))
+	if err != nil {
+		return ImageOptions{}, err
+	}
+	return ImageOptions{Format: format, Background: background, Animation: animation}, nil
+}
+
+// parseImageFormat parses the "format" form value; empty means auto.
+func parseImageFormat(value string) (ImageFormat, error) {
+	switch format := ImageFormat(strings.ToLower(strings.TrimSpace(value))); format {
+	case "":
+		return ImageFormatAuto, nil
+	case "jpg":
+		return ImageFormatJPEG, nil
+	case ImageFormatAuto, ImageFormatJPEG, ImageFormatPNG, ImageFormatWebP, ImageFormatOriginal:
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid format %q: use auto, jpeg, png, webp or original", value)
+}
+
+// parseHexColor parses a CSS-style "#rrggbb" or "#rgb" color, with or without
+// the "#"; empty means white.
+func parseHexColor(value string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(value), "#")
+	if hex == "" {
+		return color.NRGBA{R: 255, G: 255, B: 255, A: 255}, nil
+	}
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 {
+		return color.NRGBA{}, fmt.Errorf("invalid background %q: use a color such as #ffffff", value)
+	}
+	return color.NRGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 255}, nil
+}
+
+// outputFormat is the format an image uploaded as filename is saved in.
+func outputFormat(filename string, format ImageFormat, transparent bool) ImageFormat {
+	switch format {
+	case ImageFormatAuto:
+		if transparent {
+			return ImageFormatPNG
+		}
+		return ImageFormatJPEG
+	case ImageFormatOriginal:
+		ext := strings.ToLower(filepath.Ext(filename))
+		for candidate, exts := range imageExtensions {
+			if slices.Contains(exts, ext) {
+				return candidate
+			}
+		}
+		// Formats that can't be written, such as HEIC, are saved as auto
+		// would save them.
+		return outputFormat(filename, ImageFormatAuto, transparent)
+	}
+	return format
+}
+
+// hasTransparency reports whether any pixel of img isn't fully opaque.
+func hasTransparency(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// flatten draws img onto a background of the given color, for formats without
+// transparency.
+func flatten(img image.Image, background color.NRGBA) image.Image {
+	bounds := img.Bounds()
+	return imaging.Overlay(imaging.New(bounds.Dx(), bounds.Dy(), background), img, image.Pt(0, 0), 1)
+}
+
+// imageQuality is the encoder quality, 1 to 100, that format gets at quality.
+// PNG sources headed for JPEG get a little less, as they were never lossy to
+// begin with and have more to gain.
+func imageQuality(filename string, format ImageFormat, quality CompressionQuality) int {
+	qualities := map[CompressionQuality]int{QualityHigh: 90, QualityMedium: 80, QualityLow: 65}
+	switch {
+	case format == ImageFormatWebP:
+		qualities = map[CompressionQuality]int{QualityHigh: 85, QualityMedium: 75, QualityLow: 60}
+	case strings.ToLower(filepath.Ext(filename)) == ".png":
+		qualities = map[CompressionQuality]int{QualityHigh: 85, QualityMedium: 75, QualityLow: 60}
+	}
+	return qualities[quality]
+}
+
+// pngColors is how many colors PNGs are quantized to at each quality. At high
+// quality every color is kept and the image is only re-encoded at maximum
+// compression.
+var pngColors = map[CompressionQuality]int{
+	QualityHigh:   0,
+	QualityMedium: 256,
+	QualityLow:    64,
+}
+
+// encodeImage writes img, uploaded as filename, to w in format at quality.
+// format must be a concrete format as returned by outputFormat.
+func encodeImage(w io.Writer, img image.Image, filename string, format ImageFormat, quality CompressionQuality) error {
+	encoderQuality := imageQuality(filename, format, quality)
+	switch format {
+	case ImageFormatJPEG:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: encoderQuality})
+	case ImageFormatPNG:
+		if colors := pngColors[quality]; colors > 0 {
+			img = quantize(img, colors)
+		}
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		return encoder.Encode(w, img)
+	case ImageFormatWebP:
+		return encodeWebP(w, img, encoderQuality)
+	}
+	if other, ok := imagingFormats[format]; ok {
+		return imaging.Encode(w, img, other)
+	}
+	return fmt.Errorf("unsupported image format %q", format)
+}
+
+// encodeWebP encodes img with ffmpeg's libwebp, the same ffmpeg that
+// compresses videos, since Go has no WebP encoder. The image is handed over as
+// a PNG so nothing, including transparency, is lost on the way.
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	input := new(bytes.Buffer)
+	if err := (&png.Encoder{CompressionLevel: png.NoCompression}).Encode(input, img); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("ffmpeg",
+		"-f", "png_pipe",
+		"-i", "pipe:0",
+		"-c:v", "libwebp",
+		"-quality", strconv.Itoa(quality),
+		"-f", "webp",
+		"pipe:1",
+	)
+	cmd.Stdin = input
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg webp encoding failed: %w", err)
+	}
+	return nil
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"html"
 	"io"
 	"mime/multipart"
+	"net/url"
 	"os"
 	"sort"
 	"strconv"
@@ -15,6 +18,7 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 )
 
 var URL string
@@ -38,6 +42,13 @@ func main() {
 		appLogger.Warn("Error loading .env file, proceeding with system environment variables")
 	}
 
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			appLogger.WithError(err).Fatal("Command failed")
+		}
+		return
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -50,11 +61,21 @@ func main() {
 
 	URL = fmt.Sprintf("%s:%v/", baseURL, port) // ex: http://localhost:8080/
 
+	if err := initShareIDs(); err != nil {
+		appLogger.WithError(err).Fatal("Invalid share ID settings")
+	}
+
 	err = initDB()
 	if err != nil {
 		appLogger.WithError(err).Fatal("Database initialization failed")
 	}
 
+	if os.Getenv("MIGRATE_ON_START") == "true" {
+		if _, err := migrateUp(DB, 0); err != nil {
+			appLogger.WithError(err).Fatal("Database migration failed")
+		}
+	}
+
 	redisClient := initRedis()
 
 	app := fiber.New(fiber.Config{
@@ -66,6 +87,12 @@ func main() {
 
 	s3Client := initS3()
 
+	startPendingCleanup(s3Client)
+
+	if interval, err := time.ParseDuration(os.Getenv("RECONCILE_INTERVAL")); err == nil && interval > 0 {
+		startReconciler(s3Client, redisClient, interval)
+	}
+
 	app.Get("/", func(ctx *fiber.Ctx) error {
 		ctx.Set(fiber.HeaderContentType, "text/html")
 		return ctx.SendFile("pages/index.htmx")
@@ -140,6 +167,12 @@ func main() {
 			return ctx.SendString("<p>Error: Invalid total chunks</p>")
 		}
 
+		opts, err := uploadOptionsFromForm(ctx)
+		if err != nil {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
+		}
+
 		chunkFile, err := ctx.FormFile("chunk")
 		if err != nil {
 			ctx.Status(fiber.StatusBadRequest)
@@ -195,7 +228,7 @@ func main() {
 
 			upload.mu.Unlock()
 
-			_, err = s3Client.UploadFile(userId, filename, bytes.NewReader(assembled), totalSize)
+			stored, err := s3Client.UploadFile(userId, filename, bytes.NewReader(assembled), totalSize, opts)
 
 			uploadsMu.Lock()
 			delete(activeUploads, uploadId)
@@ -207,6 +240,16 @@ func main() {
 			}
 
 			logWithFields(ctx, logrus.Fields{"filename": filename}).Info("File uploaded successfully (chunked)")
+
+			redisClient.deleteShareCache(getUserID(ctx))
+
+			if wantsJSON(ctx) {
+				return ctx.JSON(toShareInfo(*stored))
+			}
+		}
+
+		if wantsJSON(ctx) {
+			return ctx.JSON(fiber.Map{"received": receivedCount, "total": total})
 		}
 
 		redisClient.deleteShareCache(getUserID(ctx))
@@ -229,32 +272,116 @@ func main() {
 			return ctx.SendString("<p>Error: Could not parse form data</p>")
 		}
 
+		// Besides the uploaded files, an archive can take in files that are
+		// already stored, selected by their share links.
 		files := form.File["zip-files"]
-		if len(files) == 0 {
+		shareIds := form.Value["share_ids"]
+		if len(files) == 0 && len(shareIds) == 0 {
 			ctx.Status(fiber.StatusBadRequest)
 			return ctx.SendString("<p>Error: No files selected</p>")
 		}
 
-		zipBuffer, err := createZip(files)
+		opts, err := uploadOptionsFromForm(ctx)
 		if err != nil {
-			logWithContext(ctx).WithError(err).Error("Error creating zip")
-			ctx.Status(fiber.StatusInternalServerError)
-			return ctx.SendString("<p>Error creating zip archive</p>")
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
 		}
 
-		zipFilename := fmt.Sprintf("archive_%d.zip", time.Now().Unix())
+		archive, err := archiveOptionsFromForm(ctx)
+		if err != nil {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
+		}
+		archive.StripMetadata = opts.StripMetadata
+		if archive.SplitSize > 0 && opts.Password != "" {
+			// The parts are shared as a collection, which has no password.
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: Split archives can't be password-protected; encrypt them with archive_password instead</p>")
+		}
 
-		_, err = s3Client.UploadFile(userId, zipFilename, bytes.NewReader(zipBuffer.Bytes()), int64(zipBuffer.Len()))
+		entries, err := formEntries(files, form.Value["paths"], form.Value["modes"])
 		if err != nil {
-			logWithContext(ctx).WithError(err).Error("Error uploading zip")
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
+		}
+
+		uploadIDs, err := uploadIDsForShares(shareIds, userId)
+		if err != nil {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
+		}
+		if len(uploadIDs) > 0 {
+			uploads, err := loadUploads(uploadIDs)
+			if err != nil {
+				logWithContext(ctx).WithError(err).Error("Error loading selected uploads")
+				ctx.Status(fiber.StatusInternalServerError)
+				return ctx.SendString("<p>Error loading files</p>")
+			}
+			for _, upload := range uploads {
+				if upload.MissingAt != nil {
+					ctx.Status(fiber.StatusNotFound)
+					return ctx.SendString(fmt.Sprintf("<p>Error: %s is no longer available</p>", html.EscapeString(upload.Filename)))
+				}
+			}
+			entries = append(entries, s3Client.uploadEntries(uploads)...)
+		}
+
+		// A split archive is stored as numbered parts plus a manifest, grouped
+		// in a collection so recipients get every part from one link.
+		if archive.SplitSize > 0 {
+			parts, err := s3Client.UploadSplit(userId, archive.Name, archive.SplitSize, minArchiveSize(entries, archive), opts, func(w io.Writer) error {
+				return createArchive(w, entries, archive)
+			})
+			if errors.Is(err, errTooManyParts) {
+				ctx.Status(fiber.StatusBadRequest)
+				return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
+			}
+			if err != nil {
+				logWithContext(ctx).WithError(err).Error("Error creating split archive")
+				ctx.Status(fiber.StatusInternalServerError)
+				return ctx.SendString(fmt.Sprintf("<p>Error creating archive: %v</p>", err))
+			}
+
+			partIDs := make([]uint, len(parts))
+			for i, part := range parts {
+				partIDs[i] = part.ID
+			}
+			collection, err := createCollection(userId, archive.Name, partIDs, opts.ShareIDStyle)
+			if err != nil {
+				logWithContext(ctx).WithError(err).Error("Error creating collection for archive parts")
+				ctx.Status(fiber.StatusInternalServerError)
+				return ctx.SendString("<p>The archive parts were stored, but creating their collection failed.</p>")
+			}
+
+			redisClient.deleteShareCache(userId)
+
+			logWithFields(ctx, logrus.Fields{"zip_filename": archive.Name, "file_count": len(entries), "part_count": len(parts) - 1}).Info("Split archive created and uploaded successfully")
+
+			if wantsJSON(ctx) {
+				return sendCollection(ctx, collection)
+			}
+			link := collectionURL(collection.Link)
+			return ctx.SendString(fmt.Sprintf(`<p>Archive %s created successfully in %d parts! (%d files)</p><p>All parts: <a href="%s">%s</a></p>`,
+				html.EscapeString(archive.Name), len(parts)-1, len(entries), link, link))
+		}
+
+		stored, err := s3Client.UploadStream(userId, archive.Name, opts, func(w io.Writer) error {
+			return createArchive(w, entries, archive)
+		})
+		if err != nil {
+			logWithContext(ctx).WithError(err).Error("Error creating archive")
 			ctx.Status(fiber.StatusInternalServerError)
-			return ctx.SendString(fmt.Sprintf("<p>Error uploading zip file: %v</p>", err))
+			return ctx.SendString(fmt.Sprintf("<p>Error creating archive: %v</p>", err))
 		}
 
 		redisClient.deleteShareCache(getUserID(ctx))
 
-		logWithFields(ctx, logrus.Fields{"zip_filename": zipFilename, "file_count": len(files)}).Info("Zip file created and uploaded successfully")
-		return ctx.SendString(fmt.Sprintf("<p>Zip %s created successfully! (%d files)</p>", zipFilename, len(files)))
+		logWithFields(ctx, logrus.Fields{"zip_filename": archive.Name, "file_count": len(entries), "file_size": stored.FileSize}).Info("Archive created and uploaded successfully")
+
+		if wantsJSON(ctx) {
+			return ctx.JSON(toShareInfo(*stored))
+		}
+		return ctx.SendString(fmt.Sprintf("<p>Archive %s created successfully! (%d files)</p>", html.EscapeString(archive.Name), len(entries)))
 	})
 
 	app.Post("/compress-media", func(ctx *fiber.Ctx) error {
@@ -269,6 +396,18 @@ func main() {
 		qualityStr := ctx.FormValue("quality")
 		quality := getCompressionQuality(qualityStr)
 
+		imageOpts, err := imageOptionsFromForm(ctx)
+		if err != nil {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
+		}
+
+		opts, err := uploadOptionsFromForm(ctx)
+		if err != nil {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
+		}
+
 		mediaFiles, err := ctx.MultipartForm()
 		if err != nil {
 			ctx.Status(fiber.StatusBadRequest)
@@ -289,7 +428,11 @@ func main() {
 			if strings.HasPrefix(contentType, "video/") {
 				videoFiles = append(videoFiles, file)
 			} else if strings.HasPrefix(contentType, "image/") {
-				imageFiles = append(imageFiles, file)
+				if imageOpts.Animation != AnimationGIF && isAnimatedGIF(file) {
+					videoFiles = append(videoFiles, file)
+				} else {
+					imageFiles = append(imageFiles, file)
+				}
 			}
 		}
 
@@ -300,18 +443,23 @@ func main() {
 
 		var successCount int
 		var failedFiles []string
+		var shares []shareInfo
 
 		for _, file := range imageFiles {
-			compressed, err := compressImage(file, quality)
+			compressed, format, err := compressImage(file, quality, imageOpts)
 			if err != nil {
 				logWithFields(ctx, logrus.Fields{"filename": file.Filename, "error": err.Error()}).Error("Error compressing image")
 				failedFiles = append(failedFiles, file.Filename)
 				continue
 			}
 
-			compressedFilename := getCompressedFileName(file.Filename, false)
+			compressedFilename := getCompressedFileName(file.Filename, imageExtensions[format])
 
-			_, err = s3Client.UploadFile(userId, compressedFilename, bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+			// The image was re-encoded without any metadata, in formats such
+			// as TIFF that stripMetadata would refuse.
+			imageUploadOpts := opts
+			imageUploadOpts.StripMetadata = false
+			stored, err := s3Client.UploadFile(userId, compressedFilename, bytes.NewReader(compressed.Bytes()), int64(compressed.Len()), imageUploadOpts)
 			if err != nil {
 				logWithFields(ctx, logrus.Fields{"filename": file.Filename, "error": err.Error()}).Error("Error uploading compressed image")
 				failedFiles = append(failedFiles, file.Filename)
@@ -319,6 +467,7 @@ func main() {
 			}
 
 			successCount++
+			shares = append(shares, toShareInfo(*stored))
 			logWithFields(ctx, logrus.Fields{
 				"filename":          file.Filename,
 				"original_size":     formatBytes(uint64(file.Size)),
@@ -328,16 +477,31 @@ func main() {
 		}
 
 		for _, file := range videoFiles {
-			compressed, err := compressVideo(file, quality)
+			// Videos are encoded as MP4, keeping their extension only if it is
+			// one of MP4's own. Animated GIFs are only here when they are to
+			// be converted, and get the extension of what they become.
+			container, exts := "mp4", []string{".mp4", ".m4v", ".mov"}
+			if strings.HasPrefix(file.Header.Get("Content-Type"), "image/") {
+				container = string(imageOpts.Animation)
+				exts = []string{"." + container}
+			}
+
+			compressed, err := compressVideo(file, quality, container, opts.StripMetadata)
 			if err != nil {
 				logWithFields(ctx, logrus.Fields{"filename": file.Filename, "error": err.Error()}).Error("Error compressing video")
 				failedFiles = append(failedFiles, file.Filename)
 				continue
 			}
 
-			compressedFilename := getCompressedFileName(file.Filename, true)
+			compressedFilename := getCompressedFileName(file.Filename, exts)
 
-			_, err = s3Client.UploadFile(userId, compressedFilename, bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+			// The video is streamed from its temporary file, which ffmpeg has
+			// already stripped if asked to.
+			stored, err := s3Client.UploadStream(userId, compressedFilename, opts, func(w io.Writer) error {
+				_, err := io.Copy(w, compressed)
+				return err
+			})
+			compressed.Close()
 			if err != nil {
 				logWithFields(ctx, logrus.Fields{"filename": file.Filename, "error": err.Error()}).Error("Error uploading compressed video")
 				failedFiles = append(failedFiles, file.Filename)
@@ -345,11 +509,12 @@ func main() {
 			}
 
 			successCount++
+			shares = append(shares, toShareInfo(*stored))
 			logWithFields(ctx, logrus.Fields{
 				"filename":          file.Filename,
 				"original_size":     formatBytes(uint64(file.Size)),
-				"compressed_size":   formatBytes(uint64(compressed.Len())),
-				"reduction_percent": (1 - float64(compressed.Len())/float64(file.Size)) * 100,
+				"compressed_size":   formatBytes(uint64(compressed.Size)),
+				"reduction_percent": (1 - float64(compressed.Size)/float64(file.Size)) * 100,
 			}).Info("Video compressed successfully")
 		}
 
@@ -358,12 +523,16 @@ func main() {
 			return ctx.SendString("<p>All media compression failed</p>")
 		}
 
+		redisClient.deleteShareCache(getUserID(ctx))
+
+		if wantsJSON(ctx) {
+			return ctx.JSON(fiber.Map{"shares": shares, "failed": failedFiles})
+		}
+
 		if len(failedFiles) > 0 {
 			return ctx.SendString(fmt.Sprintf("<p> %d files compressed successfully. Failed: %v</p>", successCount, failedFiles))
 		}
 
-		redisClient.deleteShareCache(getUserID(ctx))
-
 		return ctx.SendString(fmt.Sprintf("<p>Successfully compressed %d files!</p>", successCount))
 	})
 
@@ -387,6 +556,14 @@ func main() {
 			redisClient.setShareCache(userID, uploads)
 		}
 
+		if wantsJSON(ctx) {
+			shares := make([]shareInfo, 0, len(uploads))
+			for _, upload := range uploads {
+				shares = append(shares, toShareInfo(upload))
+			}
+			return ctx.JSON(shares)
+		}
+
 		if len(uploads) == 0 {
 			return ctx.SendString(`
         <div class="has-text-centered py-6">
@@ -398,40 +575,19 @@ func main() {
 
 		var html strings.Builder
 		for _, upload := range uploads {
-
-			fileUrl := fmt.Sprintf("%sshare/%s", URL, upload.ShareLink)
-
-			fmt.Fprintf(&html, `
-        <div class="box mb-3">
-            <div class="is-flex is-justify-content-space-between is-align-items-center">
-                <div class="is-flex is-align-items-center" style="gap: 1rem; flex: 1;">
-                    <div style="font-size: 1.5rem;">📄</div>
-                    <div style="flex: 1;">
-                        <div class="has-text-weight-semibold">%s</div>
-                        <div class="has-text-grey is-size-7">%s</div>
-                    </div>
-                </div>
-                <div class="is-flex" style="gap: 0.5rem;">
-                    <button class="button is-small is-primary is-light" onclick="copyLink('%s')">
-                        <span class="icon is-small">
-                            <span>📋</span>
-                        </span>
-                        <span>Copy Link</span>
-                    </button>
-                </div>
-            </div>
-        </div>
-        `, upload.Filename, formatBytes(uint64(upload.FileSize)), fileUrl)
+			html.WriteString(renderShareBox(upload))
 		}
 
 		return ctx.SendString(html.String())
 	})
 
-	app.Get("/share/:id", func(ctx *fiber.Ctx) error {
+	// Share links are downloaded with GET; password-protected links post their
+	// password form back to the same URL.
+	serveShare := func(ctx *fiber.Ctx) error {
 		shareId := ctx.Params("id")
 
-		var upload Upload
-		if err := DB.Where(&Upload{ShareLink: shareId}).First(&upload).Error; err != nil {
+		share, err := findShare(shareId)
+		if err != nil {
 			ctx.Status(fiber.StatusNotFound)
 			ctx.Set(fiber.HeaderContentType, "text/html")
 
@@ -439,30 +595,791 @@ func main() {
 			return ctx.SendString("<p>File not found</p>")
 		}
 
-		fileStream, err := s3Client.getFileStream(upload.FileKey)
+		if status, message := shareUnavailable(share); status != 0 {
+			ctx.Status(status)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+
+			logWithFields(ctx, logrus.Fields{"share_id": shareId, "file_key": share.Upload.FileKey, "reason": message}).Info("Share link unavailable")
+			return ctx.SendString(fmt.Sprintf("<p>%s</p>", message))
+		}
+
+		unlocked, password := unlockShare(ctx, share)
+		if !unlocked {
+			ctx.Status(fiber.StatusUnauthorized)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+
+			if password != "" {
+				logWithFields(ctx, logrus.Fields{"share_id": shareId}).Warn("Wrong share password")
+			}
+			return ctx.SendString(renderPasswordPage("/share/"+url.PathEscape(shareId), password != ""))
+		}
+
+		claimed, err := claimDownload(share)
 		if err != nil {
 			ctx.Status(fiber.StatusInternalServerError)
 			ctx.Set(fiber.HeaderContentType, "text/html")
 
+			logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error counting share download")
+			return ctx.SendString("<p>Error retrieving file</p>")
+		}
+		if !claimed {
+			ctx.Status(fiber.StatusGone)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+			return ctx.SendString("<p>This link has reached its download limit</p>")
+		}
+
+		if err := s3Client.sendUpload(ctx, share.Upload); err != nil {
+			releaseDownload(share)
+			ctx.Status(fiber.StatusInternalServerError)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+
 			logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error retrieving file stream")
 			return ctx.SendString("<p>Error retrieving file</p>")
 		}
-		defer fileStream.Close()
 
-		ctx.Set(fiber.HeaderContentType, "application/octet-stream")
-		ctx.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"%s\"", upload.Filename))
-		ctx.Set(fiber.HeaderContentLength, fmt.Sprintf("%d", upload.FileSize))
+		return nil
+	}
+	app.Get("/share/:id", serveShare)
+	app.Post("/share/:id", serveShare)
+
+	// Previews follow the link's policy, except for the owner, whose list of
+	// shares shows them even for password-protected links. They don't count as
+	// downloads.
+	serveSharePreview := func(storyboard bool) fiber.Handler {
+		return func(ctx *fiber.Ctx) error {
+			share, err := findShare(ctx.Params("id"))
+			if err != nil {
+				return ctx.SendStatus(fiber.StatusNotFound)
+			}
+
+			if share.Upload.UserID != getUserID(ctx) {
+				if status, _ := shareUnavailable(share); status != 0 {
+					return ctx.SendStatus(status)
+				}
+				if share.PasswordHash != "" {
+					return ctx.SendStatus(fiber.StatusUnauthorized)
+				}
+			}
+
+			ctx.Set(fiber.HeaderCacheControl, "private, max-age=86400")
+			return s3Client.sendPreview(ctx, share.Upload, storyboard)
+		}
+	}
+	app.Get("/share/:id/thumb", serveSharePreview(false))
+	app.Get("/share/:id/storyboard", serveSharePreview(true))
+
+	// unlockArchiveShare loads the share of an archive listing or entry request,
+	// answering with an error or the password page itself when it can't be used.
+	unlockArchiveShare := func(ctx *fiber.Ctx) (*Share, bool) {
+		shareId := ctx.Params("id")
+		ctx.Set(fiber.HeaderContentType, "text/html")
+
+		share, err := findShare(shareId)
+		if err != nil {
+			ctx.Status(fiber.StatusNotFound)
+			ctx.SendString("<p>File not found</p>")
+			return nil, false
+		}
+
+		if status, message := shareUnavailable(share); status != 0 {
+			ctx.Status(status)
+			ctx.SendString(fmt.Sprintf("<p>%s</p>", message))
+			return nil, false
+		}
+
+		if archiveFormatOf(share.Upload.Filename) == "" {
+			ctx.Status(fiber.StatusNotFound)
+			ctx.SendString("<p>This share is not an archive</p>")
+			return nil, false
+		}
+
+		unlocked, password := unlockShare(ctx, share)
+		if !unlocked {
+			if password != "" {
+				logWithFields(ctx, logrus.Fields{"share_id": shareId}).Warn("Wrong share password")
+			}
+			ctx.Status(fiber.StatusUnauthorized)
+			ctx.SendString(renderPasswordPage(html.EscapeString(ctx.Path()), password != ""))
+			return nil, false
+		}
+		return share, true
+	}
+
+	serveEntries := func(ctx *fiber.Ctx) error {
+		share, ok := unlockArchiveShare(ctx)
+		if !ok {
+			return nil
+		}
+		shareId := ctx.Params("id")
 
-		written, err := io.Copy(ctx.Response().BodyWriter(), fileStream)
+		entries, err := s3Client.archiveEntries(share.Upload)
 		if err != nil {
-			if written == 0 {
-				logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Failed to start file transfer")
-			} else {
-				logWithFields(ctx, logrus.Fields{"share_id": shareId, "bytes_sent": written}).Debug("Client disconnected during transfer")
+			logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error listing archive entries")
+			ctx.Status(fiber.StatusInternalServerError)
+			return ctx.SendString("<p>Error reading archive</p>")
+		}
+
+		if wantsJSON(ctx) {
+			infos := make([]entryInfo, 0, len(entries))
+			for _, entry := range entries {
+				infos = append(infos, toEntryInfo(shareId, entry))
 			}
+			return ctx.JSON(fiber.Map{"filename": share.Upload.Filename, "entries": infos})
+		}
+		unlock := ""
+		if share.PasswordHash != "" {
+			unlock = share.unlockToken(time.Now().Add(unlockTokenTTL))
+		}
+		return ctx.SendString(renderEntriesPage(shareId, *share.Upload, entries, unlock))
+	}
+	app.Get("/share/:id/entries", serveEntries)
+	app.Post("/share/:id/entries", serveEntries)
+
+	// Single entries count as a download of the link, like the whole archive.
+	serveEntry := func(ctx *fiber.Ctx) error {
+		share, ok := unlockArchiveShare(ctx)
+		if !ok {
+			return nil
+		}
+		shareId := ctx.Params("id")
+
+		entryPath, err := url.PathUnescape(ctx.Params("*"))
+		if err != nil {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: Invalid entry path</p>")
 		}
 
+		entry, err := s3Client.findArchiveEntry(share.Upload, entryPath)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(fiber.StatusNotFound)
+			return ctx.SendString("<p>File not found in archive</p>")
+		}
+		if err != nil {
+			logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error finding archive entry")
+			ctx.Status(fiber.StatusInternalServerError)
+			return ctx.SendString("<p>Error reading archive</p>")
+		}
+		if entry.Encrypted {
+			ctx.Status(fiber.StatusUnsupportedMediaType)
+			return ctx.SendString("<p>This file is encrypted; download the whole archive to open it</p>")
+		}
+
+		claimed, err := claimDownload(share)
+		if err != nil {
+			logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error counting share download")
+			ctx.Status(fiber.StatusInternalServerError)
+			return ctx.SendString("<p>Error retrieving file</p>")
+		}
+		if !claimed {
+			ctx.Status(fiber.StatusGone)
+			return ctx.SendString("<p>This link has reached its download limit</p>")
+		}
+
+		if err := s3Client.sendArchiveEntry(ctx, share.Upload, entry); err != nil {
+			releaseDownload(share)
+			logWithFields(ctx, logrus.Fields{"share_id": shareId, "entry": entryPath, "error": err.Error()}).Error("Error streaming archive entry")
+			ctx.Status(fiber.StatusInternalServerError)
+			return ctx.SendString("<p>Error retrieving file</p>")
+		}
+
+		logWithFields(ctx, logrus.Fields{"share_id": shareId, "entry": entryPath}).Info("Archive entry downloaded")
 		return nil
+	}
+	app.Get("/share/:id/entry/*", serveEntry)
+	app.Post("/share/:id/entry/*", serveEntry)
+
+	app.Delete("/share/:id", func(ctx *fiber.Ctx) error {
+		ctx.Set(fiber.HeaderContentType, "text/html")
+		shareId := ctx.Params("id")
+
+		userId := getUserID(ctx)
+		if userId == "" {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: User ID is required</p>")
+		}
+
+		share, err := findOwnedShare(shareId, userId)
+		if err != nil {
+			ctx.Status(fiber.StatusNotFound)
+			return ctx.SendString("<p>File not found</p>")
+		}
+
+		if err := DB.Delete(share.Upload).Error; err != nil {
+			logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error deleting share")
+			ctx.Status(fiber.StatusInternalServerError)
+			return ctx.SendString("<p>Error deleting share</p>")
+		}
+
+		redisClient.deleteShareCache(userId)
+
+		logWithFields(ctx, logrus.Fields{"share_id": shareId}).Info("Share deleted")
+		if wantsJSON(ctx) {
+			return ctx.JSON(fiber.Map{"deleted": shareId})
+		}
+		return ctx.SendString("")
+	})
+
+	app.Get("/share/:id/links", func(ctx *fiber.Ctx) error {
+		ctx.Set(fiber.HeaderContentType, "text/html")
+		shareId := ctx.Params("id")
+
+		userId := getUserID(ctx)
+		if userId == "" {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: User ID is required</p>")
+		}
+
+		share, err := findOwnedShare(shareId, userId)
+		if err != nil {
+			ctx.Status(fiber.StatusNotFound)
+			return ctx.SendString("<p>File not found</p>")
+		}
+
+		upload, err := loadUploadWithShares(share.UploadID)
+		if err != nil {
+			logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error loading share links")
+			ctx.Status(fiber.StatusInternalServerError)
+			return ctx.SendString("<p>Error loading share links</p>")
+		}
+
+		if wantsJSON(ctx) {
+			return ctx.JSON(toShareInfo(upload))
+		}
+		return ctx.SendString(renderShareBox(upload))
+	})
+
+	app.Post("/share/:id/links", func(ctx *fiber.Ctx) error {
+		ctx.Set(fiber.HeaderContentType, "text/html")
+		shareId := ctx.Params("id")
+
+		userId := getUserID(ctx)
+		if userId == "" {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: User ID is required</p>")
+		}
+
+		share, err := findOwnedShare(shareId, userId)
+		if err != nil {
+			ctx.Status(fiber.StatusNotFound)
+			return ctx.SendString("<p>File not found</p>")
+		}
+
+		opts, err := uploadOptionsFromForm(ctx)
+		if err != nil {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
+		}
+
+		link, err := newShare(share.UploadID, opts)
+		if err == nil {
+			err = createShare(link, opts.ShareIDStyle)
+		}
+		if err != nil {
+			logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error creating share link")
+			ctx.Status(fiber.StatusInternalServerError)
+			return ctx.SendString("<p>Error creating share link</p>")
+		}
+
+		redisClient.deleteShareCache(userId)
+
+		logWithFields(ctx, logrus.Fields{"share_id": link.Link, "upload_id": link.UploadID, "label": link.Label}).Info("Share link created")
+		ctx.Status(fiber.StatusCreated)
+		return sendLinkUpdate(ctx, link)
+	})
+
+	app.Post("/share/:id/revoke", func(ctx *fiber.Ctx) error {
+		ctx.Set(fiber.HeaderContentType, "text/html")
+		shareId := ctx.Params("id")
+
+		userId := getUserID(ctx)
+		if userId == "" {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: User ID is required</p>")
+		}
+
+		share, err := findOwnedShare(shareId, userId)
+		if err != nil {
+			ctx.Status(fiber.StatusNotFound)
+			return ctx.SendString("<p>File not found</p>")
+		}
+
+		if share.RevokedAt == nil {
+			now := time.Now()
+			if err := DB.Model(share).Update("revoked_at", now).Error; err != nil {
+				logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error revoking share link")
+				ctx.Status(fiber.StatusInternalServerError)
+				return ctx.SendString("<p>Error revoking share link</p>")
+			}
+			share.RevokedAt = &now
+		}
+
+		redisClient.deleteShareCache(userId)
+
+		logWithFields(ctx, logrus.Fields{"share_id": share.Link}).Info("Share link revoked")
+		return sendLinkUpdate(ctx, share)
+	})
+
+	app.Post("/share/:id/rotate", func(ctx *fiber.Ctx) error {
+		ctx.Set(fiber.HeaderContentType, "text/html")
+		shareId := ctx.Params("id")
+
+		userId := getUserID(ctx)
+		if userId == "" {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: User ID is required</p>")
+		}
+
+		share, err := findOwnedShare(shareId, userId)
+		if err != nil {
+			ctx.Status(fiber.StatusNotFound)
+			return ctx.SendString("<p>File not found</p>")
+		}
+		if share.RevokedAt != nil {
+			ctx.Status(fiber.StatusConflict)
+			return ctx.SendString("<p>Error: Revoked links can't be rotated</p>")
+		}
+
+		style, err := parseShareIDStyle(ctx.FormValue("link_style"))
+		if err != nil {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
+		}
+
+		oldLink := share.Link
+		if err := rotateShare(share, style); err != nil {
+			logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error rotating share link")
+			ctx.Status(fiber.StatusInternalServerError)
+			return ctx.SendString("<p>Error rotating share link</p>")
+		}
+
+		redisClient.deleteShareCache(userId)
+
+		logWithFields(ctx, logrus.Fields{"share_id": share.Link, "old_share_id": oldLink}).Info("Share link rotated")
+		return sendLinkUpdate(ctx, share)
+	})
+
+	// Extracting unpacks an archive the user shared into one upload per file,
+	// each with its own link. The archive itself stays shared.
+	app.Post("/share/:id/extract", func(ctx *fiber.Ctx) error {
+		ctx.Set(fiber.HeaderContentType, "text/html")
+		shareId := ctx.Params("id")
+
+		userId := getUserID(ctx)
+		if userId == "" {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: User ID is required</p>")
+		}
+
+		share, err := findOwnedShare(shareId, userId)
+		if err != nil || share.Upload.MissingAt != nil {
+			ctx.Status(fiber.StatusNotFound)
+			return ctx.SendString("<p>File not found</p>")
+		}
+		format := archiveFormatOf(share.Upload.Filename)
+		if format == "" {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: Only zip files and tarballs can be extracted</p>")
+		}
+
+		opts, err := uploadOptionsFromForm(ctx)
+		if err != nil {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
+		}
+		if ctx.FormValue("collection") == "true" && opts.Password != "" {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", errCollectionPassword))
+		}
+
+		extracted, skipped, err := s3Client.extractArchive(share.Upload, userId, opts)
+		if errors.Is(err, errExtractLimit) || errors.Is(err, errCannotStrip) {
+			logWithFields(ctx, logrus.Fields{"share_id": shareId, "reason": err.Error()}).Warn("Archive refused for extraction")
+			ctx.Status(fiber.StatusUnprocessableEntity)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %s</p>", html.EscapeString(err.Error())))
+		}
+		if err != nil {
+			logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error extracting archive")
+			ctx.Status(fiber.StatusInternalServerError)
+			return ctx.SendString("<p>Error extracting archive</p>")
+		}
+		if len(extracted) == 0 {
+			ctx.Status(fiber.StatusUnprocessableEntity)
+			return ctx.SendString("<p>Error: The archive has no files to extract</p>")
+		}
+
+		redisClient.deleteShareCache(userId)
+
+		uploadIDs := make([]uint, len(extracted))
+		for i, upload := range extracted {
+			uploadIDs[i] = upload.ID
+		}
+
+		// With collection=true the extracted files are also grouped under one
+		// link, titled after the archive unless collection_title is sent.
+		var collection *Collection
+		if ctx.FormValue("collection") == "true" {
+			title := strings.TrimSpace(ctx.FormValue("collection_title"))
+			if title == "" {
+				title = strings.TrimSuffix(share.Upload.Filename, archiveFormats[format].Ext)
+			}
+			collection, err = createCollection(userId, title, uploadIDs, opts.ShareIDStyle)
+			if err != nil {
+				logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error creating collection for extracted files")
+			}
+		}
+
+		logWithFields(ctx, logrus.Fields{"share_id": shareId, "file_count": len(extracted), "skipped": skipped}).Info("Archive extracted")
+
+		if wantsJSON(ctx) {
+			files := make([]shareInfo, 0, len(extracted))
+			for _, id := range uploadIDs {
+				upload, err := loadUploadWithShares(id)
+				if err != nil {
+					continue
+				}
+				files = append(files, toShareInfo(upload))
+			}
+			result := fiber.Map{"files": files, "skipped": skipped}
+			if collection != nil {
+				if loaded, err := findCollection(collection.Link); err == nil {
+					result["collection"] = toCollectionInfo(*loaded)
+				}
+			}
+			return ctx.JSON(result)
+		}
+
+		message := fmt.Sprintf("<p>Extracted %d files from %s.</p>", len(extracted), html.EscapeString(share.Upload.Filename))
+		if skipped > 0 {
+			message += fmt.Sprintf("<p>Skipped %d links, encrypted files or repeated names.</p>", skipped)
+		}
+		if collection != nil {
+			link := collectionURL(collection.Link)
+			message += fmt.Sprintf(`<p>Collection: <a href="%s">%s</a></p>`, link, link)
+		} else if ctx.FormValue("collection") == "true" {
+			message += "<p>The files were extracted, but creating their collection failed.</p>"
+		}
+		return ctx.SendString(message)
+	})
+
+	app.Put("/share/:id/slug", func(ctx *fiber.Ctx) error {
+		ctx.Set(fiber.HeaderContentType, "text/html")
+		shareId := ctx.Params("id")
+
+		userId := getUserID(ctx)
+		if userId == "" {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: User ID is required</p>")
+		}
+
+		share, err := findOwnedShare(shareId, userId)
+		if err != nil {
+			ctx.Status(fiber.StatusNotFound)
+			return ctx.SendString("<p>File not found</p>")
+		}
+
+		var slug *string
+		requested := strings.ToLower(strings.TrimSpace(ctx.FormValue("slug")))
+		if requested != "" {
+			if err := validateSlug(requested); err != nil {
+				ctx.Status(fiber.StatusBadRequest)
+				return ctx.SendString(fmt.Sprintf("<p>Error: %s</p>", err.Error()))
+			}
+
+			taken, err := slugIsLink(requested)
+			if err != nil {
+				logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error checking share slug")
+				ctx.Status(fiber.StatusInternalServerError)
+				return ctx.SendString("<p>Error updating share link</p>")
+			}
+			if taken {
+				ctx.Status(fiber.StatusConflict)
+				return ctx.SendString("<p>Error: That link is already taken</p>")
+			}
+			slug = &requested
+		}
+
+		if err := DB.Model(share).Update("slug", slug).Error; err != nil {
+			if _, ok := uniqueViolation(err); ok {
+				ctx.Status(fiber.StatusConflict)
+				return ctx.SendString("<p>Error: That link is already taken</p>")
+			}
+			logWithFields(ctx, logrus.Fields{"share_id": shareId, "error": err.Error()}).Error("Error updating share slug")
+			ctx.Status(fiber.StatusInternalServerError)
+			return ctx.SendString("<p>Error updating share link</p>")
+		}
+		share.Slug = slug
+
+		redisClient.deleteShareCache(userId)
+
+		logWithFields(ctx, logrus.Fields{"share_id": share.Link, "slug": requested}).Info("Share slug updated")
+		return sendLinkUpdate(ctx, share)
+	})
+
+	app.Post("/collections", func(ctx *fiber.Ctx) error {
+		ctx.Set(fiber.HeaderContentType, "text/html")
+
+		userId := getUserID(ctx)
+		if userId == "" {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: User ID is required</p>")
+		}
+
+		style, err := parseShareIDStyle(ctx.FormValue("link_style"))
+		if err != nil {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
+		}
+
+		uploadIDs, err := uploadIDsForShares(formValues(ctx, "share_ids"), userId)
+		if err != nil {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
+		}
+		if len(uploadIDs) == 0 {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: No shares selected</p>")
+		}
+
+		collection, err := createCollection(userId, strings.TrimSpace(ctx.FormValue("title")), uploadIDs, style)
+		if err != nil {
+			logWithContext(ctx).WithError(err).Error("Error creating collection")
+			ctx.Status(fiber.StatusInternalServerError)
+			return ctx.SendString("<p>Error creating collection</p>")
+		}
+
+		logWithFields(ctx, logrus.Fields{"collection": collection.Link, "file_count": len(uploadIDs)}).Info("Collection created")
+		ctx.Status(fiber.StatusCreated)
+		return sendCollection(ctx, collection)
+	})
+
+	app.Get("/collections", func(ctx *fiber.Ctx) error {
+		ctx.Set(fiber.HeaderContentType, "text/html")
+
+		userId := getUserID(ctx)
+		if userId == "" {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: User ID is required</p>")
+		}
+
+		var links []string
+		if err := DB.Model(&Collection{}).Where("user_id = ?", userId).Order("created_at DESC").Pluck("link", &links).Error; err != nil {
+			logWithContext(ctx).WithError(err).Error("Error retrieving collections")
+			ctx.Status(fiber.StatusInternalServerError)
+			return ctx.SendString("<p>Error retrieving collections</p>")
+		}
+
+		collections := make([]Collection, 0, len(links))
+		for _, link := range links {
+			collection, err := findCollection(link)
+			if err != nil {
+				logWithFields(ctx, logrus.Fields{"collection": link, "error": err.Error()}).Error("Error loading collection")
+				continue
+			}
+			collections = append(collections, *collection)
+		}
+
+		if wantsJSON(ctx) {
+			infos := make([]collectionInfo, 0, len(collections))
+			for _, collection := range collections {
+				infos = append(infos, toCollectionInfo(collection))
+			}
+			return ctx.JSON(infos)
+		}
+
+		var html strings.Builder
+		for _, collection := range collections {
+			html.WriteString(renderCollectionBox(collection))
+		}
+		return ctx.SendString(html.String())
+	})
+
+	app.Get("/c/:id", func(ctx *fiber.Ctx) error {
+		ctx.Set(fiber.HeaderContentType, "text/html")
+		collectionId := ctx.Params("id")
+
+		collection, err := findCollection(collectionId)
+		if err != nil {
+			logWithFields(ctx, logrus.Fields{"collection": collectionId, "error": err.Error()}).Info("Collection not found")
+			ctx.Status(fiber.StatusNotFound)
+			return ctx.SendString("<p>Collection not found</p>")
+		}
+
+		if wantsJSON(ctx) {
+			return ctx.JSON(toCollectionInfo(*collection))
+		}
+		return ctx.SendString(renderCollectionPage(*collection))
+	})
+
+	app.Get("/c/:id/file/:upload", func(ctx *fiber.Ctx) error {
+		collectionId := ctx.Params("id")
+
+		collection, err := findCollection(collectionId)
+		if err != nil {
+			ctx.Status(fiber.StatusNotFound)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+			return ctx.SendString("<p>Collection not found</p>")
+		}
+
+		uploadID, _ := ctx.ParamsInt("upload")
+		upload, ok := collection.collectionUpload(uint(uploadID))
+		if !ok || upload.MissingAt != nil {
+			ctx.Status(fiber.StatusNotFound)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+			return ctx.SendString("<p>File not found</p>")
+		}
+		share := collectionShare(upload)
+		if share == nil {
+			ctx.Status(fiber.StatusGone)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+			return ctx.SendString("<p>This file is no longer shared</p>")
+		}
+
+		claimed, err := claimDownload(share)
+		if err != nil {
+			ctx.Status(fiber.StatusInternalServerError)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+
+			logWithFields(ctx, logrus.Fields{"collection": collectionId, "upload_id": upload.ID, "error": err.Error()}).Error("Error counting collection download")
+			return ctx.SendString("<p>Error retrieving file</p>")
+		}
+		if !claimed {
+			ctx.Status(fiber.StatusGone)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+			return ctx.SendString("<p>This file has reached its download limit</p>")
+		}
+
+		if err := s3Client.sendUpload(ctx, upload); err != nil {
+			releaseDownload(share)
+			ctx.Status(fiber.StatusInternalServerError)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+
+			logWithFields(ctx, logrus.Fields{"collection": collectionId, "upload_id": upload.ID, "error": err.Error()}).Error("Error retrieving file stream")
+			return ctx.SendString("<p>Error retrieving file</p>")
+		}
+		return nil
+	})
+
+	serveCollectionPreview := func(storyboard bool) fiber.Handler {
+		return func(ctx *fiber.Ctx) error {
+			collection, err := findCollection(ctx.Params("id"))
+			if err != nil {
+				return ctx.SendStatus(fiber.StatusNotFound)
+			}
+
+			uploadID, _ := ctx.ParamsInt("upload")
+			upload, ok := collection.collectionUpload(uint(uploadID))
+			if !ok || collectionShare(upload) == nil {
+				return ctx.SendStatus(fiber.StatusNotFound)
+			}
+
+			ctx.Set(fiber.HeaderCacheControl, "public, max-age=86400")
+			return s3Client.sendPreview(ctx, upload, storyboard)
+		}
+	}
+	app.Get("/c/:id/thumb/:upload", serveCollectionPreview(false))
+	app.Get("/c/:id/storyboard/:upload", serveCollectionPreview(true))
+
+	app.Get("/c/:id/zip", func(ctx *fiber.Ctx) error {
+		collectionId := ctx.Params("id")
+
+		collection, err := findCollection(collectionId)
+		if err != nil {
+			ctx.Status(fiber.StatusNotFound)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+			return ctx.SendString("<p>Collection not found</p>")
+		}
+
+		// The zip counts as one download of each file in it; files whose
+		// limit was reached in the meantime are left out.
+		var uploads []Upload
+		for _, upload := range collectionUploads(collection) {
+			claimed, err := claimDownload(collectionShare(&upload))
+			if err != nil {
+				for i := range uploads {
+					releaseDownload(collectionShare(&uploads[i]))
+				}
+				ctx.Status(fiber.StatusInternalServerError)
+				ctx.Set(fiber.HeaderContentType, "text/html")
+
+				logWithFields(ctx, logrus.Fields{"collection": collectionId, "upload_id": upload.ID, "error": err.Error()}).Error("Error counting collection download")
+				return ctx.SendString("<p>Error retrieving files</p>")
+			}
+			if claimed {
+				uploads = append(uploads, upload)
+			}
+		}
+		if len(uploads) == 0 {
+			ctx.Status(fiber.StatusNotFound)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+			return ctx.SendString("<p>No files available</p>")
+		}
+
+		return s3Client.streamZip(ctx, archiveFilename(collection.Title, collection.Link, ".zip"), uploads)
+	})
+
+	app.Delete("/c/:id", func(ctx *fiber.Ctx) error {
+		ctx.Set(fiber.HeaderContentType, "text/html")
+		collectionId := ctx.Params("id")
+
+		userId := getUserID(ctx)
+		if userId == "" {
+			ctx.Status(fiber.StatusBadRequest)
+			return ctx.SendString("<p>Error: User ID is required</p>")
+		}
+
+		result := DB.Where("link = ? AND user_id = ?", collectionId, userId).Delete(&Collection{})
+		if result.Error != nil {
+			logWithFields(ctx, logrus.Fields{"collection": collectionId, "error": result.Error.Error()}).Error("Error deleting collection")
+			ctx.Status(fiber.StatusInternalServerError)
+			return ctx.SendString("<p>Error deleting collection</p>")
+		}
+		if result.RowsAffected == 0 {
+			ctx.Status(fiber.StatusNotFound)
+			return ctx.SendString("<p>Collection not found</p>")
+		}
+
+		logWithFields(ctx, logrus.Fields{"collection": collectionId}).Info("Collection deleted")
+		if wantsJSON(ctx) {
+			return ctx.JSON(fiber.Map{"deleted": collectionId})
+		}
+		return ctx.SendString("")
+	})
+
+	app.Get("/download-zip", func(ctx *fiber.Ctx) error {
+		userId := getUserID(ctx)
+		if userId == "" {
+			ctx.Status(fiber.StatusBadRequest)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+			return ctx.SendString("<p>Error: User ID is required</p>")
+		}
+
+		uploadIDs, err := uploadIDsForShares(formValues(ctx, "share_ids"), userId)
+		if err != nil {
+			ctx.Status(fiber.StatusBadRequest)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+			return ctx.SendString(fmt.Sprintf("<p>Error: %v</p>", err))
+		}
+		if len(uploadIDs) == 0 {
+			ctx.Status(fiber.StatusBadRequest)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+			return ctx.SendString("<p>Error: No shares selected</p>")
+		}
+
+		uploads, err := loadUploads(uploadIDs)
+		if err != nil {
+			logWithContext(ctx).WithError(err).Error("Error loading selected uploads")
+			ctx.Status(fiber.StatusInternalServerError)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+			return ctx.SendString("<p>Error loading files</p>")
+		}
+		uploads = availableUploads(uploads)
+		if len(uploads) == 0 {
+			ctx.Status(fiber.StatusNotFound)
+			ctx.Set(fiber.HeaderContentType, "text/html")
+			return ctx.SendString("<p>No files available</p>")
+		}
+
+		return s3Client.streamZip(ctx, archiveFilename(ctx.Query("name"), "supashare", ".zip"), uploads)
 	})
 
 	app.Get("/health", func(ctx *fiber.Ctx) error {
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Privacy mode strips the metadata that can tell where, when and with what a
+// file was made: EXIF (including GPS and camera serials), XMP and IPTC in
+// images, and container tags, chapters and timed metadata tracks in videos.
+// Images are stripped without re-encoding; videos are remuxed by ffmpeg
+// without re-encoding. Images it can't strip are refused, and other files are
+// stored unchanged.
+
+// stripMetadataByDefault reports whether privacy mode is on for every upload.
+func stripMetadataByDefault() bool {
+	return os.Getenv("STRIP_METADATA") == "true"
+}
+
+// videoExtensions are the containers stripMetadata remuxes.
+var videoExtensions = map[string]bool{
+	".mp4": true, ".m4v": true, ".mov": true, ".mkv": true, ".webm": true, ".avi": true,
+}
+
+// unstrippableExtensions are image formats that can carry EXIF or XMP that
+// stripMetadata can't take out, and that aren't always told by their content.
+var unstrippableExtensions = map[string]bool{
+	".heic": true, ".heif": true, ".avif": true, ".tif": true, ".tiff": true,
+}
+
+// heifBrands are the ISO BMFF brands of HEIC, HEIF and AVIF images.
+var heifBrands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true, "hevc": true, "hevx": true,
+	"mif1": true, "msf1": true, "avif": true, "avis": true,
+}
+
+var (
+	errBadImage    = errors.New("malformed image")
+	errCannotStrip = errors.New("can't strip metadata from this kind of image")
+)
+
+// stripMetadata returns data, the contents of filename, without identifying
+// metadata.
+func stripMetadata(filename string, data []byte) ([]byte, error) {
+	strip := metadataStripper(filename, data)
+	if strip == nil {
+		return data, nil
+	}
+	return strip(data)
+}
+
+// stripMetadataReader is stripMetadata for a file read from r. Files that
+// stripMetadata stores unchanged are passed through as r is read; the rest
+// are read into memory and stripped, and size is their new size. size is -1
+// when r is passed through.
+func stripMetadataReader(filename string, r io.Reader) (_ io.Reader, size int64, err error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	strip := metadataStripper(filename, head)
+	if strip == nil {
+		return br, -1, nil
+	}
+
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return nil, 0, err
+	}
+	stripped, err := strip(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(stripped), int64(len(stripped)), nil
+}
+
+// metadataStripper returns how to strip filename, whose contents start with
+// head, or nil when it has no metadata to strip. Images are recognized by
+// their content, videos by extension. Any other image, such as HEIC or TIFF,
+// gets a stripper that refuses it, so privacy mode fails closed instead of
+// storing it with its metadata.
+func metadataStripper(filename string, head []byte) func([]byte) ([]byte, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	sniffed := http.DetectContentType(head)
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return stripJPEGMetadata
+	case bytes.HasPrefix(head, pngSignature):
+		return stripPNGMetadata
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return stripWebPMetadata
+	case bytes.HasPrefix(head, []byte("GIF8")):
+		return stripGIFMetadata
+	case videoExtensions[ext]:
+		return func(data []byte) ([]byte, error) {
+			return stripVideoMetadata(filename, data)
+		}
+	case sniffed == "image/bmp":
+		return nil // BMP has nowhere to keep metadata
+	case isImageFile(filename), strings.HasPrefix(sniffed, "image/"), unstrippableExtensions[ext],
+		bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")),
+		len(head) >= 12 && string(head[4:8]) == "ftyp" && heifBrands[string(head[8:12])]:
+		return func([]byte) ([]byte, error) {
+			return nil, fmt.Errorf("%w: %s", errCannotStrip, filename)
+		}
+	}
+	return nil
+}
+
+// stripJPEGMetadata drops the APP1 (EXIF and XMP), APP13 (IPTC) and comment
+// segments of a JPEG, along with any other application segment a viewer
+// doesn't need. JFIF, ICC color profiles and Adobe color transforms stay. The
+// EXIF orientation is carried over in a minimal EXIF segment of its own, so
+// phone photos still display upright.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	orientation := 0
+	var kept []byte
+	pos := 2
+	for {
+		if pos+4 > len(data) || data[pos] != 0xFF {
+			return nil, fmt.Errorf("%w: bad JPEG segment at %d", errBadImage, pos)
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			pos++ // fill byte
+			continue
+		}
+		if marker == 0xDA {
+			// Start of scan: the rest is image data.
+			kept = append(kept, data[pos:]...)
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, fmt.Errorf("%w: bad JPEG segment length at %d", errBadImage, pos)
+		}
+		payload := data[pos+4 : end]
+
+		keep := true
+		switch {
+		case marker == 0xE1:
+			if o := exifOrientation(payload); o > 1 {
+				orientation = o
+			}
+			keep = false
+		case marker == 0xE2:
+			keep = bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+		case marker == 0xE0, marker == 0xEE:
+			// JFIF and Adobe; without the latter some CMYK JPEGs decode wrongly.
+		case marker >= 0xE3 && marker <= 0xEF, marker == 0xFE:
+			keep = false
+		}
+		if keep {
+			kept = append(kept, data[pos:end]...)
+		}
+		pos = end
+	}
+
+	// The orientation goes first, or right after a JFIF segment, which has to
+	// come first itself.
+	at := 0
+	if orientation > 1 && len(kept) > 4 && kept[1] == 0xE0 {
+		at = 2 + int(binary.BigEndian.Uint16(kept[2:]))
+	}
+	out.Write(kept[:at])
+	if orientation > 1 {
+		out.Write(orientationSegment(orientation))
+	}
+	out.Write(kept[at:])
+	return out.Bytes(), nil
+}
+
+// exifOrientation reads the orientation tag from the payload of an APP1
+// segment, or returns 0 when it has none.
+func exifOrientation(payload []byte) int {
+	if !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) || len(payload) < 14 {
+		return 0
+	}
+	tiff := payload[6:]
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// orientationSegment is an APP1 segment holding nothing but an EXIF
+// orientation tag.
+func orientationSegment(orientation int) []byte {
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08")
+	exif = binary.BigEndian.AppendUint16(exif, 1)      // one IFD entry
+	exif = binary.BigEndian.AppendUint16(exif, 0x0112) // Orientation
+	exif = binary.BigEndian.AppendUint16(exif, 3)      // SHORT
+	exif = binary.BigEndian.AppendUint32(exif, 1)
+	exif = binary.BigEndian.AppendUint16(exif, uint16(orientation))
+	exif = append(exif, 0, 0)
+	exif = binary.BigEndian.AppendUint32(exif, 0) // no next IFD
+
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(exif)+2))
+	return append(segment, exif...)
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are the PNG chunks stripPNGMetadata drops. XMP is stored
+// in an iTXt chunk.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true,
+}
+
+// stripPNGMetadata drops the EXIF, text and timestamp chunks of a PNG.
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	for pos := len(pngSignature); pos < len(data); {
+		if pos+12 > len(data) {
+			return nil, fmt.Errorf("%w: truncated PNG chunk at %d", errBadImage, pos)
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, fmt.Errorf("%w: bad PNG chunk length at %d", errBadImage, pos)
+		}
+		chunk := data[pos:end]
+		if crc32.ChecksumIEEE(chunk[4:8+length]) != binary.BigEndian.Uint32(chunk[8+length:]) {
+			return nil, fmt.Errorf("%w: bad PNG chunk checksum at %d", errBadImage, pos)
+		}
+
+		if !pngMetadataChunks[string(chunk[4:8])] {
+			out.Write(chunk)
+		}
+		pos = end
+	}
+	return out.Bytes(), nil
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks of a WebP and clears their
+// flags in the VP8X header.
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	var chunks []byte
+	for pos := 12; pos < len(data); {
+		if pos+8 > len(data) {
+			return nil, fmt.Errorf("%w: truncated WebP chunk at %d", errBadImage, pos)
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size + size%2
+		if end > len(data) {
+			return nil, fmt.Errorf("%w: bad WebP chunk size at %d", errBadImage, pos)
+		}
+
+		switch string(data[pos : pos+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := bytes.Clone(data[pos:end])
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04 // EXIF and XMP present
+			}
+			chunks = append(chunks, chunk...)
+		default:
+			chunks = append(chunks, data[pos:end]...)
+		}
+		pos = end
+	}
+
+	out := []byte("RIFF")
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(chunks)+4))
+	out = append(out, "WEBP"...)
+	return append(out, chunks...), nil
+}
+
+// gifKeptApplications are the application extensions stripGIFMetadata keeps,
+// which only say how often an animation loops.
+var gifKeptApplications = map[string]bool{"NETSCAPE2.0": true, "ANIMEXTS1.0": true}
+
+// stripGIFMetadata drops the comment extensions of a GIF and its application
+// extensions other than looping, which is where XMP and editors' notes go.
+// Frames, their graphic controls and plain text extensions are copied as they
+// are.
+func stripGIFMetadata(data []byte) ([]byte, error) {
+	if len(data) < 13 {
+		return nil, fmt.Errorf("%w: GIF header is truncated", errBadImage)
+	}
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&7 + 1) // global color table
+	}
+	if pos > len(data) {
+		return nil, fmt.Errorf("%w: GIF color table is truncated", errBadImage)
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:pos])
+	for {
+		if pos >= len(data) {
+			return nil, fmt.Errorf("%w: GIF is truncated", errBadImage)
+		}
+		start := pos
+		keep := true
+		switch data[pos] {
+		case 0x21:
+			if pos+2 > len(data) {
+				return nil, fmt.Errorf("%w: GIF is truncated", errBadImage)
+			}
+			label := data[pos+1]
+			pos += 2
+			switch label {
+			case 0xF9, 0x01: // graphic control, plain text
+			case 0xFF:
+				// The first sub-block is the application's 11-byte name.
+				keep = pos+12 <= len(data) && data[pos] == 11 && gifKeptApplications[string(data[pos+1:pos+12])]
+			default:
+				keep = false
+			}
+		case 0x2C:
+			if pos+11 > len(data) {
+				return nil, fmt.Errorf("%w: GIF image descriptor is truncated", errBadImage)
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&7 + 1) // local color table
+			}
+			pos++ // LZW minimum code size
+		case 0x3B:
+			out.WriteByte(0x3B)
+			return out.Bytes(), nil
+		default:
+			return nil, fmt.Errorf("%w: unknown GIF block 0x%02x at %d", errBadImage, data[pos], pos)
+		}
+
+		// Both are followed by data sub-blocks up to an empty one.
+		for {
+			if pos >= len(data) {
+				return nil, fmt.Errorf("%w: GIF is truncated", errBadImage)
+			}
+			size := int(data[pos])
+			pos += 1 + size
+			if size == 0 {
+				break
+			}
+		}
+		if keep {
+			out.Write(data[start:pos])
+		}
+	}
+}
+
+// stripVideoMetadata remuxes a video without its global and per-stream tags
+// or chapters, keeping only its video, audio and subtitle streams, so timed
+// metadata tracks such as the location track of iPhone videos are dropped
+// too. The streams are copied, not re-encoded. ffmpeg works on temporary
+// files because MP4 and MOV can't be reliably read or written through pipes.
+func stripVideoMetadata(filename string, data []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "supashare-strip-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	input := filepath.Join(dir, "input"+ext)
+	output := filepath.Join(dir, "output"+ext)
+	if err := os.WriteFile(input, data, 0o600); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("ffmpeg",
+		"-i", input,
+		"-map", "0:v",
+		"-map", "0:a?",
+		"-map", "0:s?",
+		"-map_metadata", "-1",
+		"-map_chapters", "-1",
+		"-c", "copy",
+		"-fflags", "+bitexact",
+		"-y", output,
+	)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed to strip video metadata: %w", err)
+	}
+	return os.ReadFile(output)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// migrationLockKey is the pg_advisory_lock key held while migrating, so replicas
+// starting together with MIGRATE_ON_START don't apply the same migration twice.
+const migrationLockKey = 0x5375706173686172 // "Supashar"
+
+// migrations must stay in version order. Never edit one that has shipped; add a
+// new migration instead. Statements use IF [NOT] EXISTS so databases whose tables
+// were created by hand can adopt the migrations without errors.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_uploads",
+		Up: `
+CREATE TABLE IF NOT EXISTS uploads (
+	id bigserial PRIMARY KEY,
+	user_id text NOT NULL,
+	filename text NOT NULL,
+	file_key text NOT NULL,
+	file_size bigint NOT NULL,
+	share_link text,
+	uploaded_at timestamptz,
+	deleted_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_uploads_user_id ON uploads (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_uploads_file_key ON uploads (file_key);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_uploads_share_link ON uploads (share_link);
+CREATE INDEX IF NOT EXISTS idx_uploads_deleted_at ON uploads (deleted_at);`,
+		Down: `DROP TABLE IF EXISTS uploads;`,
+	},
+	{
+		Version: 2,
+		Name:    "add_uploads_expires_at",
+		Up: `
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS expires_at timestamptz;
+CREATE INDEX IF NOT EXISTS idx_uploads_expires_at ON uploads (expires_at);`,
+		Down: `
+DROP INDEX IF EXISTS idx_uploads_expires_at;
+ALTER TABLE uploads DROP COLUMN IF EXISTS expires_at;`,
+	},
+	{
+		Version: 3,
+		Name:    "add_uploads_checksum",
+		Up:      `ALTER TABLE uploads ADD COLUMN IF NOT EXISTS checksum text;`,
+		Down:    `ALTER TABLE uploads DROP COLUMN IF EXISTS checksum;`,
+	},
+	{
+		Version: 4,
+		Name:    "add_uploads_missing_at",
+		Up:      `ALTER TABLE uploads ADD COLUMN IF NOT EXISTS missing_at timestamptz;`,
+		Down:    `ALTER TABLE uploads DROP COLUMN IF EXISTS missing_at;`,
+	},
+	{
+		Version: 5,
+		Name:    "add_uploads_status",
+		Up: `
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'committed';
+CREATE INDEX IF NOT EXISTS idx_uploads_status_uploaded_at ON uploads (status, uploaded_at);`,
+		Down: `
+DROP INDEX IF EXISTS idx_uploads_status_uploaded_at;
+ALTER TABLE uploads DROP COLUMN IF EXISTS status;`,
+	},
+	{
+		Version: 6,
+		Name:    "add_uploads_slug",
+		Up: `
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS slug text;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_uploads_slug ON uploads (slug);`,
+		Down: `
+DROP INDEX IF EXISTS idx_uploads_slug;
+ALTER TABLE uploads DROP COLUMN IF EXISTS slug;`,
+	},
+	{
+		Version: 7,
+		Name:    "create_shares",
+		Up: `
+CREATE TABLE IF NOT EXISTS shares (
+	id bigserial PRIMARY KEY,
+	upload_id bigint NOT NULL REFERENCES uploads (id) ON DELETE CASCADE,
+	link text NOT NULL,
+	slug text,
+	label text NOT NULL DEFAULT '',
+	password_hash text NOT NULL DEFAULT '',
+	expires_at timestamptz,
+	max_downloads bigint,
+	downloads bigint NOT NULL DEFAULT 0,
+	revoked_at timestamptz,
+	created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_shares_upload_id ON shares (upload_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_shares_link ON shares (link);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_shares_slug ON shares (slug);
+INSERT INTO shares (upload_id, link, slug, expires_at, created_at)
+	SELECT id, share_link, slug, expires_at, uploaded_at FROM uploads
+	WHERE share_link IS NOT NULL AND share_link <> ''
+	ON CONFLICT DO NOTHING;
+ALTER TABLE uploads
+	DROP COLUMN IF EXISTS share_link,
+	DROP COLUMN IF EXISTS slug,
+	DROP COLUMN IF EXISTS expires_at;`,
+		// Going down keeps each upload's oldest live link; any further links are lost.
+		Down: `
+ALTER TABLE uploads
+	ADD COLUMN IF NOT EXISTS share_link text,
+	ADD COLUMN IF NOT EXISTS slug text,
+	ADD COLUMN IF NOT EXISTS expires_at timestamptz;
+UPDATE uploads SET share_link = s.link, slug = s.slug, expires_at = s.expires_at
+	FROM (
+		SELECT DISTINCT ON (upload_id) upload_id, link, slug, expires_at FROM shares
+		ORDER BY upload_id, revoked_at IS NOT NULL, id
+	) s
+	WHERE s.upload_id = uploads.id;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_uploads_share_link ON uploads (share_link);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_uploads_slug ON uploads (slug);
+CREATE INDEX IF NOT EXISTS idx_uploads_expires_at ON uploads (expires_at);
+DROP TABLE IF EXISTS shares;`,
+	},
+	{
+		Version: 8,
+		Name:    "create_collections",
+		Up: `
+CREATE TABLE IF NOT EXISTS collections (
+	id bigserial PRIMARY KEY,
+	user_id text NOT NULL,
+	link text NOT NULL,
+	title text NOT NULL DEFAULT '',
+	created_at timestamptz,
+	deleted_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_collections_user_id ON collections (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_collections_link ON collections (link);
+CREATE INDEX IF NOT EXISTS idx_collections_deleted_at ON collections (deleted_at);
+CREATE TABLE IF NOT EXISTS collection_uploads (
+	collection_id bigint NOT NULL REFERENCES collections (id) ON DELETE CASCADE,
+	upload_id bigint NOT NULL REFERENCES uploads (id) ON DELETE CASCADE,
+	position integer NOT NULL DEFAULT 0,
+	PRIMARY KEY (collection_id, upload_id)
+);
+CREATE INDEX IF NOT EXISTS idx_collection_uploads_upload_id ON collection_uploads (upload_id);`,
+		Down: `
+DROP TABLE IF EXISTS collection_uploads;
+DROP TABLE IF EXISTS collections;`,
+	},
+	{
+		Version: 9,
+		Name:    "create_archive_entries",
+		Up: `
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS entries_indexed_at timestamptz;
+CREATE TABLE IF NOT EXISTS archive_entries (
+	id bigserial PRIMARY KEY,
+	upload_id bigint NOT NULL REFERENCES uploads (id) ON DELETE CASCADE,
+	path text NOT NULL,
+	size bigint NOT NULL,
+	mode bigint NOT NULL DEFAULT 0,
+	modified timestamptz,
+	data_offset bigint,
+	encrypted boolean NOT NULL DEFAULT false
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_archive_entries_upload_path ON archive_entries (upload_id, path);`,
+		Down: `
+DROP TABLE IF EXISTS archive_entries;
+ALTER TABLE uploads DROP COLUMN IF EXISTS entries_indexed_at;`,
+	},
+	{
+		Version: 10,
+		Name:    "add_upload_previews",
+		Up: `
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS thumbnail_key text NOT NULL DEFAULT '';
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS storyboard_key text NOT NULL DEFAULT '';`,
+		Down: `
+ALTER TABLE uploads DROP COLUMN IF EXISTS storyboard_key;
+ALTER TABLE uploads DROP COLUMN IF EXISTS thumbnail_key;`,
+	},
+	{
+		Version: 11,
+		Name:    "add_upload_last_active_at",
+		Up: `
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS last_active_at timestamptz;`,
+		Down: `
+ALTER TABLE uploads DROP COLUMN IF EXISTS last_active_at;`,
+	},
+}
+
+// withMigrationLock runs fn on a single pooled connection holding the migration
+// advisory lock. Session-level advisory locks belong to one connection, so the
+// lock, the migrations and the unlock all have to share it.
+func withMigrationLock(db *gorm.DB, fn func(conn *gorm.DB) error) error {
+	return db.Connection(func(conn *gorm.DB) error {
+		appLogger.Debug("Waiting for migration lock")
+		if err := conn.Exec("SELECT pg_advisory_lock(?)", migrationLockKey).Error; err != nil {
+			return fmt.Errorf("Failed to acquire migration lock: %w", err)
+		}
+		defer conn.Exec("SELECT pg_advisory_unlock(?)", migrationLockKey)
+
+		if err := conn.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+	version bigint PRIMARY KEY,
+	name text NOT NULL,
+	applied_at timestamptz NOT NULL DEFAULT now()
+)`).Error; err != nil {
+			return fmt.Errorf("Failed to create schema_migrations table: %w", err)
+		}
+
+		return fn(conn)
+	})
+}
+
+func appliedMigrations(db *gorm.DB) (map[int]SchemaMigration, error) {
+	var rows []SchemaMigration
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("Failed to read schema_migrations: %w", err)
+	}
+
+	applied := make(map[int]SchemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// migrateUp applies pending migrations in order, each in its own transaction.
+// steps <= 0 applies all of them. It returns the number applied.
+func migrateUp(db *gorm.DB, steps int) (int, error) {
+	count := 0
+	err := withMigrationLock(db, func(conn *gorm.DB) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if steps > 0 && count == steps {
+				break
+			}
+
+			start := time.Now()
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Exec(m.Up).Error; err != nil {
+					return err
+				}
+				return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("Migration %d_%s failed: %w", m.Version, m.Name, err)
+			}
+
+			appLogger.WithFields(logrus.Fields{
+				"version":     m.Version,
+				"name":        m.Name,
+				"duration_ms": time.Since(start).Milliseconds(),
+			}).Info("Migration applied")
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// migrateDown rolls back the most recently applied migrations, newest first.
+func migrateDown(db *gorm.DB, steps int) (int, error) {
+	count := 0
+	err := withMigrationLock(db, func(conn *gorm.DB) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Exec(m.Down).Error; err != nil {
+					return err
+				}
+				return tx.Delete(&SchemaMigration{}, m.Version).Error
+			})
+			if err != nil {
+				return fmt.Errorf("Rollback of migration %d_%s failed: %w", m.Version, m.Name, err)
+			}
+
+			appLogger.WithFields(logrus.Fields{
+				"version": m.Version,
+				"name":    m.Name,
+			}).Info("Migration rolled back")
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+func printMigrationStatus(db *gorm.DB) error {
+	return withMigrationLock(db, func(conn *gorm.DB) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, m := range migrations {
+			status := "pending"
+			if row, ok := applied[m.Version]; ok {
+				status = row.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", m.Version, m.Name, status)
+		}
+		return tw.Flush()
+	})
+}
+
+// runMigrate implements "migrate up [n]", "migrate down [n]" and "migrate status".
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up [n] | down [n] | status")
+	}
+
+	steps := 0
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid step count %q", args[1])
+		}
+		steps = n
+	}
+
+	if err := initDB(); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		count, err := migrateUp(DB, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migration(s)\n", count)
+	case "down":
+		if steps == 0 {
+			steps = 1
+		}
+		count, err := migrateDown(DB, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rolled back %d migration(s)\n", count)
+	case "status":
+		return printMigrationStatus(DB)
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/sirupsen/logrus"
+)
+
+// multipartPartSize is the size of each part of a streaming upload. S3 requires
+// every part but the last to be at least 5 MiB.
+const multipartPartSize = 8 * 1024 * 1024
+
+// multipartWriter stores everything written to it under key, sending it to S3
+// part by part so that at most one part is held in memory. Output that fits in
+// a single part is sent with a plain PutObject instead. The SHA-256 and size of
+// the written data are tracked along the way.
+type multipartWriter struct {
+	s           *S3Client
+	key         string
+	contentType *string
+	uploadID    *string
+	buf         []byte
+	parts       []types.CompletedPart
+	size        int64
+	hash        hash.Hash
+	// heartbeat, if set, is called after each part is stored.
+	heartbeat func()
+}
+
+func (s *S3Client) newMultipartWriter(key, contentType string) *multipartWriter {
+	m := &multipartWriter{
+		s:    s,
+		key:  key,
+		buf:  make([]byte, 0, multipartPartSize),
+		hash: sha256.New(),
+	}
+	if contentType != "" {
+		m.contentType = aws.String(contentType)
+	}
+	return m
+}
+
+func (m *multipartWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	m.hash.Write(p)
+	m.size += int64(written)
+
+	for len(p) > 0 {
+		n := min(len(p), multipartPartSize-len(m.buf))
+		m.buf = append(m.buf, p[:n]...)
+		p = p[n:]
+
+		if len(m.buf) == multipartPartSize {
+			if err := m.flushPart(); err != nil {
+				return written - len(p), err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flushPart uploads the buffered data as the next part, starting the multipart
+// upload on the first call.
+func (m *multipartWriter) flushPart() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if m.uploadID == nil {
+		created, err := m.s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:      aws.String(m.s.bucketName),
+			Key:         aws.String(m.key),
+			ContentType: m.contentType,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to start multipart upload: %w", err)
+		}
+		m.uploadID = created.UploadId
+	}
+
+	partNumber := aws.Int32(int32(len(m.parts) + 1))
+	part, err := m.s.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(m.s.bucketName),
+		Key:           aws.String(m.key),
+		UploadId:      m.uploadID,
+		PartNumber:    partNumber,
+		Body:          bytes.NewReader(m.buf),
+		ContentLength: aws.Int64(int64(len(m.buf))),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload part %d: %w", *partNumber, err)
+	}
+
+	m.parts = append(m.parts, types.CompletedPart{ETag: part.ETag, PartNumber: partNumber})
+	m.buf = m.buf[:0]
+	if m.heartbeat != nil {
+		m.heartbeat()
+	}
+	return nil
+}
+
+// Close uploads whatever is still buffered and completes the object.
+func (m *multipartWriter) Close() error {
+	if m.uploadID == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		_, err := m.s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(m.s.bucketName),
+			Key:           aws.String(m.key),
+			Body:          bytes.NewReader(m.buf),
+			ContentLength: aws.Int64(int64(len(m.buf))),
+			ContentType:   m.contentType,
+		})
+		return err
+	}
+
+	if len(m.buf) > 0 {
+		if err := m.flushPart(); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := m.s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(m.s.bucketName),
+		Key:             aws.String(m.key),
+		UploadId:        m.uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: m.parts},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+// Abort discards the parts uploaded so far.
+func (m *multipartWriter) Abort() {
+	if m.uploadID == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := m.s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(m.s.bucketName),
+		Key:      aws.String(m.key),
+		UploadId: m.uploadID,
+	})
+	if err != nil {
+		appLogger.WithError(err).WithField("key", m.key).Warn("failed to abort multipart upload")
+	}
+}
+
+// abortStaleMultipartUploads aborts multipart uploads started more than
+// olderThan ago unless their upload is still pending and active, such as those
+// a crash left behind in the middle of UploadStream. Storage keeps, and bills,
+// their parts until they are aborted.
+func (s *S3Client) abortStaleMultipartUploads(olderThan time.Duration) (int, error) {
+	cutoff := time.Now().Add(-olderThan)
+	aborted := 0
+
+	paginator := s3.NewListMultipartUploadsPaginator(s.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucketName),
+	})
+	for paginator.HasMorePages() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		page, err := paginator.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return aborted, fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+
+		for _, upload := range page.Uploads {
+			if aws.ToTime(upload.Initiated).After(cutoff) {
+				continue
+			}
+			var active int64
+			if err := DB.Model(&Upload{}).
+				Where("file_key = ? AND status = ? AND COALESCE(last_active_at, uploaded_at) >= ?", aws.ToString(upload.Key), UploadStatusPending, cutoff).
+				Count(&active).Error; err != nil {
+				return aborted, fmt.Errorf("failed to check multipart upload: %w", err)
+			}
+			if active > 0 {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.bucketName),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			cancel()
+			if err != nil {
+				appLogger.WithError(err).WithField("key", aws.ToString(upload.Key)).Warn("failed to abort stale multipart upload")
+				continue
+			}
+			aborted++
+		}
+	}
+	return aborted, nil
+}
+
+// checksum is the hex SHA-256 of everything written so far.
+func (m *multipartWriter) checksum() string {
+	return hex.EncodeToString(m.hash.Sum(nil))
+}
+
+// UploadStream stores a file whose content is produced by write, streaming it
+// to storage as it is written so it never has to fit in memory. Size and
+// checksum are recorded once write returns. It doesn't strip metadata itself;
+// with opts.StripMetadata, write has to hand over stripped content.
+func (s *S3Client) UploadStream(userId, filename string, opts UploadOptions, write func(w io.Writer) error) (*Upload, error) {
+	startTime := time.Now()
+
+	appLogger.WithFields(logrus.Fields{
+		"user_id":  userId,
+		"filename": filename,
+		"bucket":   s.bucketName,
+	}).Info("starting streaming upload")
+
+	upload := &Upload{
+		UserID:   userId,
+		Filename: filename,
+		FileKey:  s.objectKeyFor(filename),
+	}
+
+	err := s.storeUpload(upload, opts, func(objectKey string) error {
+		mw := s.newMultipartWriter(objectKey, archiveContentType(filename))
+		mw.heartbeat = func() { touchUpload(upload.ID) }
+		if err := write(mw); err != nil {
+			mw.Abort()
+			return err
+		}
+		if err := mw.Close(); err != nil {
+			mw.Abort()
+			return err
+		}
+
+		upload.FileSize = mw.size
+		upload.Checksum = mw.checksum()
+		return nil
+	})
+	if err != nil {
+		appLogger.WithError(err).WithFields(logrus.Fields{
+			"user_id":  userId,
+			"filename": filename,
+			"key":      upload.FileKey,
+		}).Error("streaming upload failed")
+		return nil, err
+	}
+
+	appLogger.WithFields(logrus.Fields{
+		"user_id":   userId,
+		"filename":  filename,
+		"key":       upload.FileKey,
+		"file_size": upload.FileSize,
+		"duration":  time.Since(startTime),
+	}).Info("streaming upload completed successfully")
+
+	return upload, nil
+}
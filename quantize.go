@@ -0,0 +1,126 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+// maxQuantizeSamples caps how many pixels quantize looks at to pick a
+// palette; larger images are sampled evenly.
+const maxQuantizeSamples = 1 << 18
+
+// colorBox is a set of pixels in median cut, split until there are as many
+// boxes as palette entries.
+type colorBox []color.NRGBA
+
+// widest returns the channel, 0 to 3 for R, G, B and A, with the largest
+// spread in the box, and that spread.
+func (b colorBox) widest() (int, int) {
+	lo := [4]uint8{255, 255, 255, 255}
+	var hi [4]uint8
+	for _, c := range b {
+		for i, v := range [4]uint8{c.R, c.G, c.B, c.A} {
+			lo[i] = min(lo[i], v)
+			hi[i] = max(hi[i], v)
+		}
+	}
+
+	channel, spread := 0, -1
+	for i := range lo {
+		if s := int(hi[i]) - int(lo[i]); s > spread {
+			channel, spread = i, s
+		}
+	}
+	return channel, spread
+}
+
+// average is the color the box is represented by in the palette.
+func (b colorBox) average() color.NRGBA {
+	var sum [4]int
+	for _, c := range b {
+		sum[0] += int(c.R)
+		sum[1] += int(c.G)
+		sum[2] += int(c.B)
+		sum[3] += int(c.A)
+	}
+	n := len(b)
+	return color.NRGBA{R: uint8(sum[0] / n), G: uint8(sum[1] / n), B: uint8(sum[2] / n), A: uint8(sum[3] / n)}
+}
+
+// quantize reduces img to a palette of at most colors entries picked by median
+// cut, dithered with Floyd-Steinberg. Alpha is treated as a fourth channel, so
+// transparent and translucent areas survive; fully transparent pixels all map
+// to one entry whatever their color.
+func quantize(img image.Image, colors int) *image.Paletted {
+	bounds := img.Bounds()
+	palette := medianCut(sampleColors(img, maxQuantizeSamples), colors)
+
+	dst := image.NewPaletted(bounds, palette)
+	draw.FloydSteinberg.Draw(dst, bounds, img, bounds.Min)
+	return dst
+}
+
+// sampleColors returns up to about limit pixels of img, sampled evenly.
+func sampleColors(img image.Image, limit int) colorBox {
+	bounds := img.Bounds()
+	step := 1
+	for bounds.Dx()*bounds.Dy()/(step*step) > limit {
+		step++
+	}
+
+	var samples colorBox
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				c = color.NRGBA{}
+			}
+			samples = append(samples, c)
+		}
+	}
+	return samples
+}
+
+// medianCut picks a palette of at most colors entries for samples.
+func medianCut(samples colorBox, colors int) color.Palette {
+	if len(samples) == 0 {
+		return color.Palette{color.NRGBA{}}
+	}
+
+	boxes := []colorBox{samples}
+	for len(boxes) < colors {
+		// Split the box whose colors differ the most along one channel.
+		index, channel, spread := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if c, s := box.widest(); s > spread {
+				index, channel, spread = i, c, s
+			}
+		}
+		if index < 0 {
+			break
+		}
+
+		box := boxes[index]
+		sort.Slice(box, func(i, j int) bool {
+			return channelOf(box[i], channel) < channelOf(box[j], channel)
+		})
+		half := len(box) / 2
+		boxes[index] = box[:half]
+		boxes = append(boxes, box[half:])
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		palette[i] = box.average()
+	}
+	return palette
+}
+
+func channelOf(c color.NRGBA, channel int) uint8 {
+	return [4]uint8{c.R, c.G, c.B, c.A}[channel]
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// reconcileLockKey is the pg_try_advisory_lock key for scheduled reconciliation,
+// so only one replica reconciles at a time.
+const reconcileLockKey = 0x5375706172656331 // "Suparec1"
+
+type ReconcileOptions struct {
+	// DeleteOrphans deletes objects that no Upload row references.
+	DeleteOrphans bool
+	// MarkBroken sets MissingAt on rows whose object is gone so their share
+	// links answer 404 instead of 500. Rows whose object reappears are unmarked.
+	MarkBroken bool
+	// MinAge skips objects modified more recently than this, and rows uploaded
+	// less than this before the bucket was listed, so uploads still in flight
+	// are never mistaken for orphans or broken shares.
+	MinAge time.Duration
+	DryRun bool
+}
+
+type orphanObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+type ReconcileResult struct {
+	ObjectsScanned int
+	RowsScanned    int
+	OrphanObjects  []orphanObject
+	BrokenRows     []Upload
+	RestoredRows   []Upload
+	DeletedObjects int
+	MarkedRows     int
+	Errors         []error
+}
+
+// listObjects pages through ListObjectsV2 and returns every object in the bucket
+// keyed by its object key.
+func (s *S3Client) listObjects() (map[string]orphanObject, error) {
+	objects := make(map[string]orphanObject)
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucketName),
+		MaxKeys: aws.Int32(1000),
+	})
+	for paginator.HasMorePages() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		page, err := paginator.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			objects[key] = orphanObject{
+				Key:          key,
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			}
+		}
+	}
+
+	return objects, nil
+}
+
+// reconcile compares the bucket with the Upload table. Objects that no row
+// references (including soft-deleted rows, which keep their object until purge)
+// are orphans; live rows whose object is missing are broken shares.
+func reconcile(s3Client *S3Client, redisClient *RedisClient, opts ReconcileOptions) (*ReconcileResult, error) {
+	start := time.Now()
+	result := &ReconcileResult{}
+
+	// Rows committed after the listing started may point at objects it
+	// missed; MinAge leaves room for clock skew between here and the database.
+	listStart := time.Now()
+	objects, err := s3Client.listObjects()
+	if err != nil {
+		return nil, err
+	}
+	result.ObjectsScanned = len(objects)
+
+	referenced := make(map[string]bool)
+	var uploads []Upload
+	err = DB.Unscoped().Order("id").FindInBatches(&uploads, 1000, func(tx *gorm.DB, batch int) error {
+		for _, upload := range uploads {
+			result.RowsScanned++
+			referenced[upload.FileKey] = true
+			for _, key := range []string{upload.ThumbnailKey, upload.StoryboardKey} {
+				if key != "" {
+					referenced[key] = true
+				}
+			}
+
+			if upload.DeletedAt.Valid || upload.Status != UploadStatusCommitted {
+				continue
+			}
+
+			_, exists := objects[upload.FileKey]
+			switch {
+			case !exists && upload.MissingAt == nil:
+				if !upload.UploadedAt.Before(listStart.Add(-opts.MinAge)) {
+					continue
+				}
+				result.BrokenRows = append(result.BrokenRows, upload)
+			case exists && upload.MissingAt != nil:
+				result.RestoredRows = append(result.RestoredRows, upload)
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan uploads: %w", err)
+	}
+
+	cutoff := time.Now().Add(-opts.MinAge)
+	for key, obj := range objects {
+		if referenced[key] || obj.LastModified.After(cutoff) {
+			continue
+		}
+		result.OrphanObjects = append(result.OrphanObjects, obj)
+	}
+
+	if !opts.DryRun && opts.DeleteOrphans {
+		for _, obj := range result.OrphanObjects {
+			if err := s3Client.deleteObject(obj.Key); err != nil {
+				result.Errors = append(result.Errors, err)
+				continue
+			}
+			result.DeletedObjects++
+		}
+	}
+
+	if !opts.DryRun && opts.MarkBroken {
+		now := time.Now()
+		for _, upload := range result.BrokenRows {
+			if err := DB.Model(&upload).Update("missing_at", now).Error; err != nil {
+				result.Errors = append(result.Errors, fmt.Errorf("failed to mark row %d: %w", upload.ID, err))
+				continue
+			}
+			result.MarkedRows++
+			redisClient.deleteShareCache(upload.UserID)
+		}
+		for _, upload := range result.RestoredRows {
+			if err := DB.Model(&upload).Update("missing_at", nil).Error; err != nil {
+				result.Errors = append(result.Errors, fmt.Errorf("failed to unmark row %d: %w", upload.ID, err))
+				continue
+			}
+			redisClient.deleteShareCache(upload.UserID)
+		}
+	}
+
+	appLogger.WithFields(logrus.Fields{
+		"objects_scanned": result.ObjectsScanned,
+		"rows_scanned":    result.RowsScanned,
+		"orphan_objects":  len(result.OrphanObjects),
+		"broken_rows":     len(result.BrokenRows),
+		"restored_rows":   len(result.RestoredRows),
+		"deleted_objects": result.DeletedObjects,
+		"marked_rows":     result.MarkedRows,
+		"errors":          len(result.Errors),
+		"dry_run":         opts.DryRun,
+		"duration_ms":     time.Since(start).Milliseconds(),
+	}).Info("Reconciliation completed")
+
+	return result, nil
+}
+
+// reconcileOptionsFromEnv reads the options used by scheduled reconciliation.
+func reconcileOptionsFromEnv() ReconcileOptions {
+	opts := ReconcileOptions{
+		DeleteOrphans: os.Getenv("RECONCILE_DELETE_ORPHANS") == "true",
+		MarkBroken:    os.Getenv("RECONCILE_MARK_BROKEN") != "false",
+		MinAge:        time.Hour,
+	}
+	if minAge, err := time.ParseDuration(os.Getenv("RECONCILE_MIN_AGE")); err == nil {
+		opts.MinAge = minAge
+	}
+	return opts
+}
+
+// startReconciler runs reconcile every interval in the background. Each run
+// takes a Postgres advisory lock without waiting, so when several replicas share
+// a schedule only one of them does the work.
+func startReconciler(s3Client *S3Client, redisClient *RedisClient, interval time.Duration) {
+	opts := reconcileOptionsFromEnv()
+	appLogger.WithFields(logrus.Fields{
+		"interval":       interval.String(),
+		"delete_orphans": opts.DeleteOrphans,
+		"mark_broken":    opts.MarkBroken,
+		"min_age":        opts.MinAge.String(),
+	}).Info("Scheduled reconciliation enabled")
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			err := runExclusive(reconcileLockKey, func() error {
+				_, err := reconcile(s3Client, redisClient, opts)
+				return err
+			})
+			if err != nil {
+				appLogger.WithError(err).Error("Scheduled reconciliation failed")
+			}
+		}
+	}()
+}
@@ -90,3 +90,51 @@ func (r *RedisClient) deleteShareCache(userID string) {
 		appLogger.WithField("user_id", userID).Debug("Share cache deleted successfully")
 	}
 }
+
+// scanKeys returns every key matching pattern, using SCAN so large keyspaces
+// don't block Redis the way KEYS would.
+func (r *RedisClient) scanKeys(pattern string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	var keys []string
+	iter := r.Scan(ctx, 0, pattern, 500).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan redis keys: %w", err)
+	}
+	return keys, nil
+}
+
+// existingKeys returns those of keys that exist.
+func (r *RedisClient) existingKeys(keys ...string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	var existing []string
+	for _, key := range keys {
+		n, err := r.Exists(ctx, key).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to check redis key: %w", err)
+		}
+		if n > 0 {
+			existing = append(existing, key)
+		}
+	}
+	return existing, nil
+}
+
+func (r *RedisClient) deleteKeys(keys []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	for start := 0; start < len(keys); start += 500 {
+		end := min(start+500, len(keys))
+		if err := r.Del(ctx, keys[start:end]...).Err(); err != nil {
+			return fmt.Errorf("failed to delete redis keys: %w", err)
+		}
+	}
+	return nil
+}
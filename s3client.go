@@ -3,6 +3,9 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -12,6 +15,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/gofiber/fiber/v2"
 	"github.com/sirupsen/logrus"
 )
@@ -65,7 +69,7 @@ func initS3() *S3Client {
 	}
 }
 
-func (s *S3Client) UploadFile(userId, filename string, data io.Reader, fileSize int64) (string, error) {
+func (s *S3Client) UploadFile(userId, filename string, data io.Reader, fileSize int64, opts UploadOptions) (*Upload, error) {
 	startTime := time.Now()
 
 	appLogger.WithFields(logrus.Fields{
@@ -77,68 +81,82 @@ func (s *S3Client) UploadFile(userId, filename string, data io.Reader, fileSize
 
 	var buf bytes.Buffer
 	if _, err := io.Copy(&buf, data); err != nil {
-		return "", fmt.Errorf("error reading file data: %w", err)
+		return nil, fmt.Errorf("error reading file data: %w", err)
 	}
 
-	objectKey := filename
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(s.bucketName),
-		Key:    aws.String(objectKey),
-	})
-
-	if err == nil {
-		// Object exists, append timestamp
-		objectKey = fmt.Sprintf("%d_%s", time.Now().Unix(), filename)
+	// A file that can't be stripped isn't stored, rather than being stored
+	// with the metadata its uploader asked to remove.
+	body := buf.Bytes()
+	if opts.StripMetadata {
+		stripped, err := stripMetadata(filename, body)
+		if err != nil {
+			return nil, fmt.Errorf("error stripping metadata: %w", err)
+		}
 		appLogger.WithFields(logrus.Fields{
-			"original_filename": filename,
-			"new_object_key":    objectKey,
-		}).Info("file already exists, using new key")
+			"filename":      filename,
+			"original_size": len(body),
+			"stripped_size": len(stripped),
+		}).Debug("stripped file metadata")
+		body = stripped
+		fileSize = int64(len(body))
 	}
 
-	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	checksum := sha256.Sum256(body)
+	upload := &Upload{
+		UserID:   userId,
+		Filename: filename,
+		FileKey:  s.objectKeyFor(filename),
+		FileSize: fileSize,
+		Checksum: hex.EncodeToString(checksum[:]),
+	}
 
-	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:        aws.String(s.bucketName),
-		Key:           aws.String(objectKey),
-		Body:          bytes.NewReader(buf.Bytes()),
-		ContentLength: aws.Int64(int64(buf.Len())),
+	err := s.storeUpload(upload, opts, func(objectKey string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(s.bucketName),
+			Key:           aws.String(objectKey),
+			Body:          bytes.NewReader(body),
+			ContentLength: aws.Int64(int64(len(body))),
+		})
+		return err
 	})
 	if err != nil {
 		appLogger.WithError(err).WithFields(logrus.Fields{
 			"user_id":  userId,
 			"filename": filename,
-			"key":      objectKey,
+			"key":      upload.FileKey,
 		}).Error("file upload failed")
-		return "", fmt.Errorf("error uploading file: %w", err)
+		return nil, err
 	}
 
 	duration := time.Since(startTime)
 	appLogger.WithFields(logrus.Fields{
 		"user_id":   userId,
 		"filename":  filename,
-		"key":       objectKey,
+		"key":       upload.FileKey,
 		"file_size": fileSize,
 		"duration":  duration,
 	}).Info("file upload completed successfully")
 
-	shareLink := generateShareLink()
-	uploadRecord := Upload{
-		UserID:    userId,
-		Filename:  filename,
-		FileKey:   objectKey,
-		FileSize:  fileSize,
-		ShareLink: shareLink,
-	}
+	return upload, nil
+}
 
-	if err := DB.Create(&uploadRecord).Error; err != nil {
-		return "", fmt.Errorf("error saving upload record: %w", err)
+// objectKeyFor returns the object key for a new upload of filename, prefixing
+// the upload time when an object with that name already exists.
+func (s *S3Client) objectKeyFor(filename string) string {
+	_, exists, err := s.headObject(filename)
+	if err == nil && !exists {
+		return filename
 	}
 
-	return shareLink, nil
+	objectKey := fmt.Sprintf("%d_%s", time.Now().Unix(), filename)
+	appLogger.WithFields(logrus.Fields{
+		"original_filename": filename,
+		"new_object_key":    objectKey,
+	}).Info("file already exists, using new key")
+	return objectKey
 }
 
 func (s *S3Client) UploadCtx(ctx *fiber.Ctx) error {
@@ -147,6 +165,14 @@ func (s *S3Client) UploadCtx(ctx *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "<p>User ID is required</p>")
 	}
 
+	opts, err := uploadOptionsFromForm(ctx)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("<p>%v</p>", err))
+	}
+	if ctx.FormValue("collection") == "true" && opts.Password != "" {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("<p>%v</p>", errCollectionPassword))
+	}
+
 	form, err := ctx.MultipartForm()
 	if err != nil {
 		appLogger.WithError(err).Warn("could not parse form data")
@@ -169,6 +195,7 @@ func (s *S3Client) UploadCtx(ctx *fiber.Ctx) error {
 
 	var successCount int
 	var failedFiles []string
+	var uploadIDs []uint
 
 	for _, file := range files {
 
@@ -182,71 +209,18 @@ func (s *S3Client) UploadCtx(ctx *fiber.Ctx) error {
 			continue
 		}
 
-		// Read file content
-		var buf bytes.Buffer
-		if _, err := io.Copy(&buf, fileBuffer); err != nil {
-			appLogger.WithError(err).WithFields(logrus.Fields{
-				"filename": file.Filename,
-				"user_id":  userId,
-			}).Warn("failed to read file")
-			fileBuffer.Close()
-			failedFiles = append(failedFiles, file.Filename)
-			continue
-		}
+		upload, err := s.UploadFile(userId, file.Filename, fileBuffer, file.Size, opts)
 		fileBuffer.Close()
-
-		objectKey := file.Filename
-
-		ctxCheck, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		_, errStat := s.client.HeadObject(ctxCheck, &s3.HeadObjectInput{
-			Bucket: aws.String(s.bucketName),
-			Key:    aws.String(objectKey),
-		})
-
-		if errStat == nil {
-			objectKey = fmt.Sprintf("%d_%s", time.Now().Unix(), file.Filename)
-		}
-
-		ctxUpload, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-		_, err = s.client.PutObject(ctxUpload, &s3.PutObjectInput{
-			Bucket:        aws.String(s.bucketName),
-			Key:           aws.String(objectKey),
-			Body:          bytes.NewReader(buf.Bytes()),
-			ContentLength: aws.Int64(int64(buf.Len())),
-		})
-
 		if err != nil {
 			appLogger.WithError(err).WithFields(logrus.Fields{
-				"filename":   file.Filename,
-				"object_key": objectKey,
-				"user_id":    userId,
+				"filename": file.Filename,
+				"user_id":  userId,
 			}).Warn("failed to upload file")
 			failedFiles = append(failedFiles, file.Filename)
 			continue
 		}
-
-		shareLink := generateShareLink()
-
-		uploadRecord := Upload{
-			UserID:    userId,
-			Filename:  file.Filename,
-			FileKey:   objectKey,
-			FileSize:  file.Size,
-			ShareLink: shareLink,
-		}
-
-		if err := DB.Create(&uploadRecord).Error; err != nil {
-			appLogger.WithError(err).WithFields(logrus.Fields{
-				"filename":   file.Filename,
-				"object_key": objectKey,
-				"user_id":    userId,
-			}).Warn("failed to save upload record")
-			failedFiles = append(failedFiles, file.Filename)
-			continue
-		}
 		successCount++
+		uploadIDs = append(uploadIDs, upload.ID)
 	}
 
 	appLogger.WithFields(logrus.Fields{
@@ -260,8 +234,21 @@ func (s *S3Client) UploadCtx(ctx *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "<p>All file uploads failed</p>")
 	}
 
+	// With collection=true the uploaded files are also grouped under one link.
+	collectionNote := ""
+	if ctx.FormValue("collection") == "true" {
+		collection, err := createCollection(userId, strings.TrimSpace(ctx.FormValue("collection_title")), uploadIDs, opts.ShareIDStyle)
+		if err != nil {
+			appLogger.WithError(err).WithField("user_id", userId).Error("failed to create collection for upload")
+			collectionNote = "<p>The files were uploaded, but creating their collection failed.</p>"
+		} else {
+			url := collectionURL(collection.Link)
+			collectionNote = fmt.Sprintf(`<p>Collection: <a href="%s">%s</a></p>`, url, url)
+		}
+	}
+
 	if len(failedFiles) > 0 {
-		return ctx.SendString(fmt.Sprintf("<p>%d files uploaded successfully. Failed to upload: %v</p>", successCount, failedFiles))
+		return ctx.SendString(fmt.Sprintf("<p>%d files uploaded successfully. Failed to upload: %v</p>%s", successCount, failedFiles, collectionNote))
 	}
 
 	var uploadedFilenames []string
@@ -269,7 +256,7 @@ func (s *S3Client) UploadCtx(ctx *fiber.Ctx) error {
 		uploadedFilenames = append(uploadedFilenames, file.Filename)
 	}
 
-	return ctx.SendString(fmt.Sprintf("<p>Files %s uploaded successfully!</p>", strings.Join(uploadedFilenames, ", ")))
+	return ctx.SendString(fmt.Sprintf("<p>Files %s uploaded successfully!</p>%s", strings.Join(uploadedFilenames, ", "), collectionNote))
 }
 
 func (s *S3Client) getFileStream(fileKey string) (io.ReadCloser, error) {
@@ -278,14 +265,16 @@ func (s *S3Client) getFileStream(fileKey string) (io.ReadCloser, error) {
 		"bucket":   s.bucketName,
 	}).Debug("retrieving file stream")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	// The body is read after this returns, so the request context has to live
+	// until the caller closes the stream rather than being cancelled here.
+	ctx, body := startStream()
 
 	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(fileKey),
 	})
 	if err != nil {
+		body.Close()
 		appLogger.WithError(err).WithFields(logrus.Fields{
 			"file_key": fileKey,
 			"bucket":   s.bucketName,
@@ -293,5 +282,188 @@ func (s *S3Client) getFileStream(fileKey string) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("failed to get file stream: %w", err)
 	}
 
-	return output.Body, nil
+	body.timer.Stop()
+	body.ReadCloser = output.Body
+	return body, nil
+}
+
+// getFileRange streams length bytes of the object at fileKey starting at
+// offset, using a ranged GET.
+func (s *S3Client) getFileRange(fileKey string, offset, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	ctx, body := startStream()
+
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(fileKey),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		body.Close()
+		appLogger.WithError(err).WithFields(logrus.Fields{
+			"file_key": fileKey,
+			"offset":   offset,
+			"length":   length,
+		}).Error("failed to get file range")
+		return nil, fmt.Errorf("failed to get file range: %w", err)
+	}
+
+	body.timer.Stop()
+	body.ReadCloser = output.Body
+	return body, nil
+}
+
+// streamIdleTimeout cancels a streamed object read when storage sends nothing
+// for this long, either before responding or in the middle of the body.
+const streamIdleTimeout = time.Minute
+
+// idleTimeoutBody is an object body whose request is cancelled when storage
+// stalls for streamIdleTimeout. Only time spent waiting on storage counts, not
+// time the caller spends between reads, so slow consumers and large objects
+// take as long as they need.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	timer  *time.Timer
+}
+
+// startStream returns the context for a streamed GetObject, already timing
+// the wait for its response, and the body to hand the response body to.
+func startStream() (context.Context, *idleTimeoutBody) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return ctx, &idleTimeoutBody{cancel: cancel, timer: time.AfterFunc(streamIdleTimeout, cancel)}
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(streamIdleTimeout)
+	defer b.timer.Stop()
+	return b.ReadCloser.Read(p)
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	defer b.cancel()
+	if b.ReadCloser == nil {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// sendUpload streams upload's object to the client as an attachment. It returns
+// an error without writing a response when the object can't be opened, so the
+// caller can answer instead.
+func (s *S3Client) sendUpload(ctx *fiber.Ctx, upload *Upload) error {
+	fileStream, err := s.getFileStream(upload.FileKey)
+	if err != nil {
+		return err
+	}
+	defer fileStream.Close()
+
+	contentType := archiveContentType(upload.Filename)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	ctx.Set(fiber.HeaderContentType, contentType)
+	ctx.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"%s\"", upload.Filename))
+	ctx.Set(fiber.HeaderContentLength, fmt.Sprintf("%d", upload.FileSize))
+
+	written, err := io.Copy(ctx.Response().BodyWriter(), fileStream)
+	if err != nil {
+		if written == 0 {
+			logWithFields(ctx, logrus.Fields{"upload_id": upload.ID, "error": err.Error()}).Error("Failed to start file transfer")
+		} else {
+			logWithFields(ctx, logrus.Fields{"upload_id": upload.ID, "bytes_sent": written}).Debug("Client disconnected during transfer")
+		}
+	}
+	return nil
+}
+
+// headObject returns the size of the object at fileKey and whether it exists.
+func (s *S3Client) headObject(fileKey string) (int64, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	output, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(fileKey),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to head object: %w", err)
+	}
+
+	return aws.ToInt64(output.ContentLength), true, nil
+}
+
+func (s *S3Client) deleteObject(fileKey string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(fileKey),
+	})
+	if err != nil {
+		appLogger.WithError(err).WithFields(logrus.Fields{
+			"file_key": fileKey,
+			"bucket":   s.bucketName,
+		}).Error("failed to delete object")
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+
+	appLogger.WithField("file_key", fileKey).Debug("object deleted")
+	return nil
+}
+
+// putObject stores a small object, such as a thumbnail, from memory.
+func (s *S3Client) putObject(fileKey string, data []byte, contentType string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucketName),
+		Key:           aws.String(fileKey),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+		ContentType:   aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put object: %w", err)
+	}
+	return nil
+}
+
+// readObject reads a small object, such as a thumbnail, into memory.
+func (s *S3Client) readObject(fileKey string) ([]byte, error) {
+	stream, err := s.getFileStream(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return io.ReadAll(stream)
+}
+
+// downloadObject copies the object at fileKey to a new file at path.
+func (s *S3Client) downloadObject(fileKey, path string) error {
+	stream, err := s.getFileStream(fileKey)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, stream); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to download object: %w", err)
+	}
+	return file.Close()
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type ShareIDStyle string
+
+const (
+	// ShareIDRandom is a random string from the configured alphabet.
+	ShareIDRandom ShareIDStyle = "random"
+	// ShareIDWords is a dash-separated run of words that is easy to read aloud.
+	ShareIDWords ShareIDStyle = "words"
+	// ShareIDSecure is a long random string for sensitive shares, long enough
+	// that guessing or enumerating links is impractical.
+	ShareIDSecure ShareIDStyle = "secure"
+)
+
+const defaultShareIDAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+type ShareIDGenerator struct {
+	Alphabet     string
+	Length       int
+	SecureLength int
+	WordCount    int
+	DefaultStyle ShareIDStyle
+}
+
+var shareIDs = &ShareIDGenerator{
+	Alphabet:     defaultShareIDAlphabet,
+	Length:       10,
+	SecureLength: 24,
+	WordCount:    4,
+	DefaultStyle: ShareIDRandom,
+}
+
+// initShareIDs applies the SHARE_ID_* environment variables to the generator
+// and rejects settings that would produce unsafe or unusable IDs.
+func initShareIDs() error {
+	if alphabet := os.Getenv("SHARE_ID_ALPHABET"); alphabet != "" {
+		shareIDs.Alphabet = alphabet
+	}
+
+	for env, target := range map[string]*int{
+		"SHARE_ID_LENGTH":        &shareIDs.Length,
+		"SHARE_ID_SECURE_LENGTH": &shareIDs.SecureLength,
+		"SHARE_ID_WORDS":         &shareIDs.WordCount,
+	} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a number: %w", env, err)
+		}
+		*target = n
+	}
+
+	if style := os.Getenv("SHARE_ID_DEFAULT_STYLE"); style != "" {
+		parsed, err := parseShareIDStyle(style)
+		if err != nil {
+			return err
+		}
+		shareIDs.DefaultStyle = parsed
+	}
+
+	return shareIDs.validate()
+}
+
+func (g *ShareIDGenerator) validate() error {
+	seen := make(map[rune]bool)
+	for _, r := range g.Alphabet {
+		if r > 127 || strings.ContainsRune("/?#%&+ \t\r\n\"'<>\\", r) {
+			return fmt.Errorf("SHARE_ID_ALPHABET contains %q, which isn't safe in a URL path", r)
+		}
+		if seen[r] {
+			return fmt.Errorf("SHARE_ID_ALPHABET contains %q more than once", r)
+		}
+		seen[r] = true
+	}
+	if len(seen) < 16 {
+		return fmt.Errorf("SHARE_ID_ALPHABET needs at least 16 characters, got %d", len(seen))
+	}
+	if g.Length < 6 {
+		return fmt.Errorf("SHARE_ID_LENGTH must be at least 6, got %d", g.Length)
+	}
+	if g.SecureLength < g.Length {
+		return fmt.Errorf("SHARE_ID_SECURE_LENGTH must be at least SHARE_ID_LENGTH (%d), got %d", g.Length, g.SecureLength)
+	}
+	if g.WordCount < 3 {
+		return fmt.Errorf("SHARE_ID_WORDS must be at least 3, got %d", g.WordCount)
+	}
+	return nil
+}
+
+func parseShareIDStyle(style string) (ShareIDStyle, error) {
+	switch ShareIDStyle(style) {
+	case "":
+		return shareIDs.DefaultStyle, nil
+	case ShareIDRandom, ShareIDWords, ShareIDSecure:
+		return ShareIDStyle(style), nil
+	default:
+		return "", fmt.Errorf("unknown share link style %q", style)
+	}
+}
+
+// Generate returns a new share ID in the given style. It fails rather than
+// falling back to something predictable when the system RNG is unavailable.
+func (g *ShareIDGenerator) Generate(style ShareIDStyle) (string, error) {
+	switch style {
+	case ShareIDWords:
+		words := make([]string, g.WordCount)
+		for i := range words {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(shareIDWords))))
+			if err != nil {
+				return "", fmt.Errorf("failed to generate share ID: %w", err)
+			}
+			words[i] = shareIDWords[n.Int64()]
+		}
+		return strings.Join(words, "-"), nil
+	case ShareIDSecure:
+		return g.randomString(g.SecureLength)
+	default:
+		return g.randomString(g.Length)
+	}
+}
+
+// randomString draws length characters from the alphabet. rand.Int rejects
+// out-of-range samples, so every character is equally likely.
+func (g *ShareIDGenerator) randomString(length int) (string, error) {
+	alphabet := []rune(g.Alphabet)
+	size := big.NewInt(int64(len(alphabet)))
+
+	var sb strings.Builder
+	for range length {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate share ID: %w", err)
+		}
+		sb.WriteRune(alphabet[n.Int64()])
+	}
+	return sb.String(), nil
+}
+
+// shareIDWords has 256 short, distinct, easy-to-spell words, so each word in a
+// words-style ID carries 8 bits.
+var shareIDWords = [256]string{
+	"acorn", "adobe", "agent", "alarm", "album", "alley", "amber", "angle",
+	"ankle", "apple", "apron", "arena", "arrow", "aspen", "atlas", "attic",
+	"audio", "award", "bacon", "badge", "bagel", "baker", "banjo", "barge",
+	"basil", "beach", "beard", "bench", "berry", "bison", "blade", "blaze",
+	"bloom", "board", "bonus", "boots", "brain", "brick", "bride", "brook",
+	"brush", "bugle", "cabin", "cable", "cacao", "camel", "candy", "canoe",
+	"cargo", "cedar", "chalk", "charm", "chess", "chili", "cider", "cinch",
+	"civic", "clamp", "cliff", "clock", "cloud", "clove", "coast", "cobra",
+	"comet", "coral", "couch", "crane", "crate", "creek", "crisp", "crown",
+	"cubic", "curry", "daisy", "dance", "delta", "denim", "depot", "diary",
+	"disco", "ditto", "dodge", "donut", "draft", "drama", "dream", "drift",
+	"drum", "dune", "eagle", "easel", "ebony", "elbow", "elder", "ember",
+	"emoji", "epoch", "equal", "fable", "fairy", "feast", "fence", "ferry",
+	"fiber", "field", "flame", "flint", "float", "flock", "flora", "flute",
+	"focus", "forge", "fox", "frost", "fudge", "gecko", "ghost", "giant",
+	"glade", "globe", "glove", "grain", "grape", "graph", "grove", "guava",
+	"guide", "habit", "harp", "haven", "hazel", "heart", "hedge", "heron",
+	"honey", "hotel", "husky", "igloo", "index", "inlet", "iris", "ivory",
+	"jelly", "jewel", "joker", "juice", "kayak", "kebab", "kettle", "kiosk",
+	"koala", "label", "lagoon", "lance", "laser", "latch", "lemon", "lever",
+	"lilac", "linen", "llama", "lobby", "lodge", "lotus", "lucky", "lunar",
+	"mango", "maple", "marsh", "medal", "melon", "mercy", "metro", "mint",
+	"mocha", "model", "moose", "mossy", "motor", "mural", "nacho", "nexus",
+	"noble", "north", "novel", "nylon", "oasis", "ocean", "olive", "onion",
+	"opera", "orbit", "otter", "oxide", "paddle", "panda", "paper", "patio",
+	"peach", "pearl", "pecan", "pepper", "piano", "pilot", "pixel", "plaza",
+	"plume", "polar", "poppy", "prism", "quail", "quartz", "quest", "quilt",
+	"radar", "raven", "relay", "ridge", "river", "robin", "rocket", "rumba",
+	"saber", "salsa", "scout", "shore", "sigma", "solar", "spice", "spoon",
+	"squid", "stone", "sunny", "swirl", "tango", "thyme", "tiger", "toast",
+	"topaz", "torch", "tulip", "tundra", "ultra", "umber", "vapor", "velvet",
+	"viola", "vivid", "waltz", "wheat", "willow", "yacht", "zebra", "zesty",
+}
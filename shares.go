@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// newShare builds an unsaved link carrying the policy in opts.
+func newShare(uploadID uint, opts UploadOptions) (*Share, error) {
+	share := &Share{
+		UploadID:     uploadID,
+		Label:        opts.Label,
+		ExpiresAt:    opts.ExpiresAt,
+		MaxDownloads: opts.MaxDownloads,
+	}
+	if opts.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash share password: %w", err)
+		}
+		share.PasswordHash = string(hash)
+	}
+	return share, nil
+}
+
+// createShare inserts share under a freshly generated link, retrying with a new
+// link when the generated one is already taken.
+func createShare(share *Share, style ShareIDStyle) error {
+	var err error
+	for attempt := 1; attempt <= maxReserveAttempts; attempt++ {
+		share.ID = 0
+		share.Link, err = newShareLink(style)
+		if err != nil {
+			return err
+		}
+
+		err = DB.Create(share).Error
+		if err == nil {
+			return nil
+		}
+		if constraint, ok := uniqueViolation(err); !ok || constraint != "idx_shares_link" {
+			return fmt.Errorf("error saving share link: %w", err)
+		}
+	}
+
+	return fmt.Errorf("error saving share link after %d attempts: %w", maxReserveAttempts, err)
+}
+
+// rotateShare gives share a new link so the old URL stops working, keeping its
+// policy. The slug is cleared as well, since it is just another URL for the link.
+func rotateShare(share *Share, style ShareIDStyle) error {
+	var err error
+	for attempt := 1; attempt <= maxReserveAttempts; attempt++ {
+		var link string
+		link, err = newShareLink(style)
+		if err != nil {
+			return err
+		}
+
+		err = DB.Model(share).Updates(map[string]any{"link": link, "slug": nil}).Error
+		if err == nil {
+			share.Link = link
+			share.Slug = nil
+			return nil
+		}
+		if constraint, ok := uniqueViolation(err); !ok || constraint != "idx_shares_link" {
+			return fmt.Errorf("error rotating share link: %w", err)
+		}
+	}
+
+	return fmt.Errorf("error rotating share link after %d attempts: %w", maxReserveAttempts, err)
+}
+
+// newShareLink generates a link that doesn't collide with an existing slug.
+// Links are resolved before slugs, so such a link would hijack the vanity URL.
+func newShareLink(style ShareIDStyle) (string, error) {
+	var err error
+	for attempt := 1; attempt <= maxReserveAttempts; attempt++ {
+		var link string
+		link, err = shareIDs.Generate(style)
+		if err != nil {
+			return "", err
+		}
+
+		var taken int64
+		if err := DB.Model(&Share{}).Where("slug = ?", link).Count(&taken).Error; err != nil {
+			return "", fmt.Errorf("error checking share link: %w", err)
+		}
+		if taken == 0 {
+			return link, nil
+		}
+		err = fmt.Errorf("share link %q collides with a slug", link)
+	}
+	return "", err
+}
+
+// findShare resolves a /share/:id path segment, which is either a link or a
+// vanity slug, to its share with the committed upload preloaded. Revoked,
+// expired and used-up links are returned too; see shareUnavailable.
+func findShare(shareID string) (*Share, error) {
+	var share Share
+	err := DB.Preload("Upload", committedUploads).Where("link = ?", shareID).First(&share).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = DB.Preload("Upload", committedUploads).Where("slug = ?", shareID).First(&share).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	if share.Upload == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &share, nil
+}
+
+// findOwnedShare is findShare restricted to shares of userID's uploads.
+func findOwnedShare(shareID, userID string) (*Share, error) {
+	share, err := findShare(shareID)
+	if err != nil {
+		return nil, err
+	}
+	if share.Upload.UserID != userID {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return share, nil
+}
+
+// loadUploadWithShares loads an upload and all of its links, oldest first.
+func loadUploadWithShares(uploadID uint) (Upload, error) {
+	var upload Upload
+	err := DB.Preload("Shares", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).First(&upload, uploadID).Error
+	return upload, err
+}
+
+// shareUnavailable returns the status and message a download of share should
+// fail with, or 0 when the link's policy allows the download.
+func shareUnavailable(share *Share) (int, string) {
+	switch shareStatus(*share) {
+	case "revoked":
+		return fiber.StatusGone, "This link has been revoked"
+	case "expired":
+		return fiber.StatusGone, "This share has expired"
+	case "used up":
+		return fiber.StatusGone, "This link has reached its download limit"
+	}
+	if share.Upload.MissingAt != nil {
+		return fiber.StatusNotFound, "File is no longer available"
+	}
+	return 0, ""
+}
+
+// checkPassword reports whether password unlocks share. Links without a
+// password accept anything.
+func (s *Share) checkPassword(password string) bool {
+	if s.PasswordHash == "" {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(password)) == nil
+}
+
+// unlockTokenTTL is how long the downloads on an unlocked archive listing keep
+// working without the password being entered again.
+const unlockTokenTTL = time.Hour
+
+// postedValue returns the form value key posted in the request body. Unlike
+// FormValue it ignores the query string, as URLs end up in browser history,
+// Referer headers and proxy logs.
+func postedValue(ctx *fiber.Ctx, key string) string {
+	if ctx.Method() != fiber.MethodPost {
+		return ""
+	}
+	if form, err := ctx.MultipartForm(); err == nil {
+		if values := form.Value[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	return string(ctx.Request().PostArgs().Peek(key))
+}
+
+// unlockShare reports whether the request may use share: the link has no
+// password, or its password or an unlock token was posted. It also returns
+// the posted password, to tell a wrong one from none.
+func unlockShare(ctx *fiber.Ctx, share *Share) (bool, string) {
+	if token := postedValue(ctx, "unlock"); token != "" && share.checkUnlockToken(token) {
+		return true, ""
+	}
+	password := postedValue(ctx, "password")
+	return share.checkPassword(password), password
+}
+
+// unlockToken returns a token that stands in for the password of share until
+// expires, so pages behind it don't have to carry the password itself. It is
+// signed with the password's hash, so changing the password voids it.
+func (s *Share) unlockToken(expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(s.PasswordHash))
+	mac.Write([]byte(s.Link + "|" + expiry))
+	return expiry + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkUnlockToken reports whether token was made by unlockToken for share
+// and hasn't expired.
+func (s *Share) checkUnlockToken(token string) bool {
+	expiry, _, ok := strings.Cut(token, ".")
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if !ok || err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(s.unlockToken(time.Unix(unix, 0))))
+}
+
+// claimDownload counts one download against share. The limit is checked in the
+// same statement, so concurrent downloads can't overrun it; false means the
+// limit was reached.
+func claimDownload(share *Share) (bool, error) {
+	result := DB.Model(&Share{}).
+		Where("id = ? AND (max_downloads IS NULL OR downloads < max_downloads)", share.ID).
+		Update("downloads", gorm.Expr("downloads + 1"))
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// primaryShare is the link shown for an upload when only one fits: its oldest
+// active link, else its oldest link.
+func primaryShare(upload Upload) *Share {
+	for i := range upload.Shares {
+		if shareStatus(upload.Shares[i]) == "active" {
+			return &upload.Shares[i]
+		}
+	}
+	if len(upload.Shares) > 0 {
+		return &upload.Shares[0]
+	}
+	return nil
+}
+
+// shareStatus describes a link's state for listings.
+func shareStatus(share Share) string {
+	switch {
+	case share.RevokedAt != nil:
+		return "revoked"
+	case share.ExpiresAt != nil && share.ExpiresAt.Before(time.Now()):
+		return "expired"
+	case share.MaxDownloads != nil && share.Downloads >= *share.MaxDownloads:
+		return "used up"
+	}
+	return "active"
+}
+
+// parseMaxDownloads parses the "max_downloads" form value; empty means unlimited.
+func parseMaxDownloads(value string) (*int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid download limit %q: must be a positive number", value)
+	}
+	return &n, nil
+}
+
+// releaseDownload gives back a download claimed for a transfer that never
+// started.
+func releaseDownload(share *Share) {
+	if err := DB.Model(&Share{}).Where("id = ?", share.ID).
+		Update("downloads", gorm.Expr("GREATEST(downloads - 1, 0)")).Error; err != nil {
+		appLogger.WithError(err).WithField("share_id", share.Link).Warn("failed to release share download")
+	}
+}
+
+// sendLinkUpdate answers a link management request with the link as JSON, or
+// with its upload's re-rendered box for the web interface.
+func sendLinkUpdate(ctx *fiber.Ctx, share *Share) error {
+	if wantsJSON(ctx) {
+		return ctx.JSON(toLinkInfo(*share))
+	}
+
+	upload, err := loadUploadWithShares(share.UploadID)
+	if err != nil {
+		appLogger.WithError(err).WithField("upload_id", share.UploadID).Error("failed to load share links")
+		ctx.Status(fiber.StatusInternalServerError)
+		return ctx.SendString("<p>Error loading share links</p>")
+	}
+	return ctx.SendString(renderShareBox(upload))
+}
+
+// renderPasswordPage is the page a password-protected link shows until the
+// right password is posted back to action.
+func renderPasswordPage(action string, wrong bool) string {
+	notice := ""
+	if wrong {
+		notice = `<p class="help is-danger mb-3">Wrong password, try again.</p>`
+	}
+
+	return fmt.Sprintf(`<!Doctype html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/bulma@1.0.4/css/bulma.min.css">
+    <title>Supashare - Password required</title>
+</head>
+<body>
+    <section class="section">
+        <div class="container" style="max-width: 24rem;">
+            <div class="box">
+                <h1 class="title is-5">🔒 This share is password protected</h1>
+                %s
+                <form method="post" action="%s">
+                    <div class="field">
+                        <div class="control">
+                            <input class="input" type="password" name="password" placeholder="Password" autofocus required>
+                        </div>
+                    </div>
+                    <button class="button is-primary is-fullwidth" type="submit">Unlock</button>
+                </form>
+            </div>
+        </div>
+    </section>
+</body>
+</html>`, notice, action)
+}
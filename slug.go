@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// slugPattern allows lowercase letters, digits and single dashes between them,
+// e.g. "q3-release-notes".
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// reservedSlugs can't be claimed because they name routes or would be easy to
+// pass off as official pages.
+var reservedSlugs = map[string]bool{
+	"admin": true, "api": true, "app": true, "assets": true, "compress-media": true,
+	"create-zip": true, "delete": true, "download": true, "edit": true, "entry": true,
+	"favicon-ico": true, "health": true, "help": true, "index": true, "login": true,
+	"logout": true, "my-shares": true, "new": true, "robots-txt": true, "settings": true,
+	"share": true, "slug": true, "static": true, "supashare": true, "support": true,
+	"upload": true,
+}
+
+const (
+	minSlugLength = 3
+	maxSlugLength = 64
+)
+
+// validateSlug checks the form of a requested vanity slug. Whether it is free is
+// checked separately: against links by slugIsLink, and among slugs by the
+// unique index on shares.slug, which is enforced when the slug is saved.
+func validateSlug(slug string) error {
+	if len(slug) < minSlugLength || len(slug) > maxSlugLength {
+		return fmt.Errorf("slug must be %d to %d characters", minSlugLength, maxSlugLength)
+	}
+	if !slugPattern.MatchString(slug) {
+		return fmt.Errorf("slug may only contain lowercase letters, digits and single dashes between them")
+	}
+	if reservedSlugs[slug] {
+		return fmt.Errorf("slug %q is reserved", slug)
+	}
+
+	return nil
+}
+
+// slugIsLink reports whether slug is already some share's link. Share links
+// are matched before slugs, so such a slug would never resolve.
+func slugIsLink(slug string) (bool, error) {
+	var count int64
+	if err := DB.Model(&Share{}).Where("link = ?", slug).Count(&count).Error; err != nil {
+		return false, fmt.Errorf("failed to check slug: %w", err)
+	}
+	return count > 0, nil
+}
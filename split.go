@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// minSplitSize is the smallest part size accepted.
+	minSplitSize = 1000 * 1000
+	// maxSplitParts is the most parts one archive may be split into, which keeps
+	// part names two digits long so they sort in order.
+	maxSplitParts = 99
+)
+
+var errTooManyParts = fmt.Errorf("archive needs more than %d parts: use a larger split size", maxSplitParts)
+
+// splitUnits are the suffixes "split" accepts. They are decimal, so a part
+// sized for a "25 MB" attachment cap fits whichever way the cap is counted.
+var splitUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1000,
+	"kb": 1000,
+	"m":  1000 * 1000,
+	"mb": 1000 * 1000,
+	"g":  1000 * 1000 * 1000,
+	"gb": 1000 * 1000 * 1000,
+}
+
+// parseSplitSize parses the "split" form value, such as "25MB" or "1.5GB";
+// empty means the archive isn't split.
+func parseSplitSize(value string) (int64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return 0, nil
+	}
+
+	number := strings.TrimRight(value, "abcdefghijklmnopqrstuvwxyz ")
+	unit, ok := splitUnits[strings.TrimSpace(value[len(number):])]
+	n, err := strconv.ParseFloat(number, 64)
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid split size %q: use a size such as 25MB", value)
+	}
+
+	size := int64(n * float64(unit))
+	if size < minSplitSize {
+		return 0, fmt.Errorf("invalid split size %q: parts must be at least 1MB", value)
+	}
+	return size, nil
+}
+
+// splitPartName is the filename of part n (from 1) of filename.
+func splitPartName(filename string, n int) string {
+	return fmt.Sprintf("%s.part%02d", filename, n)
+}
+
+// minArchiveSize returns a size the archive of entries can't come in under,
+// or 0 when compression makes it unknown.
+func minArchiveSize(entries []archiveEntry, opts ArchiveOptions) int64 {
+	if opts.Format != "tar" && (opts.Format != "zip" || opts.Compression != "store") {
+		return 0
+	}
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	return total
+}
+
+// UploadSplit stores the output of write as numbered parts of at most
+// partSize bytes, each an upload of its own named by splitPartName, followed
+// by a manifest telling recipients how to join them. Like UploadStream nothing
+// is held in memory beyond the part being sent. minSize, when known, is a size
+// the output can't come in under; if that already needs more than
+// maxSplitParts parts nothing is stored at all. If anything fails, the parts
+// stored so far are deleted again.
+func (s *S3Client) UploadSplit(userId, filename string, partSize, minSize int64, opts UploadOptions, write func(w io.Writer) error) ([]Upload, error) {
+	startTime := time.Now()
+
+	if (minSize+partSize-1)/partSize > maxSplitParts {
+		return nil, errTooManyParts
+	}
+
+	pr, pw := io.Pipe()
+	whole := sha256.New()
+	go func() {
+		pw.CloseWithError(write(io.MultiWriter(pw, whole)))
+	}()
+	r := bufio.NewReader(pr)
+
+	var parts []Upload
+	fail := func(err error) ([]Upload, error) {
+		pr.CloseWithError(err)
+		s.removeUploads(parts)
+		appLogger.WithError(err).WithFields(logrus.Fields{
+			"user_id":  userId,
+			"filename": filename,
+		}).Error("split upload failed")
+		return nil, err
+	}
+
+	var total int64
+	for {
+		// Peeking first keeps an archive that ends on a part boundary from
+		// getting an empty last part.
+		if _, err := r.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return fail(err)
+		}
+		if len(parts) == maxSplitParts {
+			return fail(errTooManyParts)
+		}
+
+		part, err := s.UploadStream(userId, splitPartName(filename, len(parts)+1), opts, func(w io.Writer) error {
+			_, err := io.CopyN(w, r, partSize)
+			if err == io.EOF {
+				err = nil
+			}
+			return err
+		})
+		if err != nil {
+			return fail(err)
+		}
+		parts = append(parts, *part)
+		total += part.FileSize
+	}
+
+	manifest := splitManifest(filename, parts, total, hex.EncodeToString(whole.Sum(nil)))
+	stored, err := s.UploadStream(userId, filename+".manifest.txt", opts, func(w io.Writer) error {
+		_, err := io.WriteString(w, manifest)
+		return err
+	})
+	if err != nil {
+		return fail(err)
+	}
+	parts = append(parts, *stored)
+
+	appLogger.WithFields(logrus.Fields{
+		"user_id":    userId,
+		"filename":   filename,
+		"part_count": len(parts) - 1,
+		"file_size":  total,
+		"duration":   time.Since(startTime),
+	}).Info("split upload completed successfully")
+
+	return parts, nil
+}
+
+// splitManifest explains how to join the parts of filename and lists their
+// checksums, along with that of the joined file, in sha256sum format.
+func splitManifest(filename string, parts []Upload, total int64, checksum string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s was split into %d parts (%s in total).\n\n", filename, len(parts), formatBytes(uint64(total)))
+	sb.WriteString("Download every part into one folder, then join them in order:\n\n")
+	fmt.Fprintf(&sb, "  Linux and macOS:  cat \"%s\".part* > \"%s\"\n", filename, filename)
+
+	names := make([]string, len(parts))
+	for i := range parts {
+		names[i] = fmt.Sprintf("\"%s\"", splitPartName(filename, i+1))
+	}
+	fmt.Fprintf(&sb, "  Windows:          copy /b %s \"%s\"\n\n", strings.Join(names, "+"), filename)
+
+	sb.WriteString("SHA-256 checksums (check with sha256sum -c):\n\n")
+	for i, part := range parts {
+		fmt.Fprintf(&sb, "%s  %s\n", part.Checksum, splitPartName(filename, i+1))
+	}
+	fmt.Fprintf(&sb, "%s  %s\n", checksum, filename)
+	return sb.String()
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// thumbnailSize is the edge length of the square thumbnails shown next to
+	// shared files.
+	thumbnailSize = 240
+	// maxThumbnailSource skips thumbnails for images too large to decode cheaply.
+	maxThumbnailSource = 25 * 1024 * 1024
+	// maxThumbnailPixels skips thumbnails for images whose header claims more
+	// pixels than this, which small, highly compressed files can.
+	maxThumbnailPixels = 64 * 1000 * 1000
+	// maxConcurrentPreviews caps how many previews are generated at once, as
+	// each holds a decoded image or runs ffmpeg.
+	maxConcurrentPreviews = 2
+	// maxVideoPreviewSource skips previews for videos too large to copy to
+	// disk for ffmpeg.
+	maxVideoPreviewSource = 4 * 1024 * 1024 * 1024
+
+	// Storyboards are one JPEG of storyboardColumns by storyboardRows frames,
+	// spread evenly over the video, each storyboardTileWidth pixels wide.
+	storyboardColumns   = 5
+	storyboardRows      = 5
+	storyboardTileWidth = 160
+
+	previewTimeout = 10 * time.Minute
+)
+
+// previewSlots is taken by every preview being generated, so a burst of
+// uploads queues up for it instead of decoding everything at once.
+var previewSlots = make(chan struct{}, maxConcurrentPreviews)
+
+// previewGeneration keeps an upload's previews from being generated twice at
+// once, such as by its upload and by a view of its thumbnail.
+var previewGeneration singleflight.Group
+
+// errPreviewPending is returned for thumbnails that are queued but not made
+// yet.
+var errPreviewPending = errors.New("preview is still being generated")
+
+// thumbnailKey and storyboardKey are where the previews of the object at
+// fileKey are stored, next to it in the bucket.
+func thumbnailKey(fileKey string) string {
+	return "thumbnails/" + fileKey + ".jpg"
+}
+
+func storyboardKey(fileKey string) string {
+	return "thumbnails/" + fileKey + ".storyboard.jpg"
+}
+
+// isVideoFile reports whether filename has the extension of a video ffmpeg
+// can take previews from.
+func isVideoFile(filename string) bool {
+	return videoExtensions[strings.ToLower(filepath.Ext(filename))]
+}
+
+// canThumbnail reports whether upload has, or can be given, a thumbnail.
+func canThumbnail(upload Upload) bool {
+	if upload.ThumbnailKey != "" {
+		return true
+	}
+	if isVideoFile(upload.Filename) {
+		return upload.FileSize <= maxVideoPreviewSource
+	}
+	return isImageFile(upload.Filename) && upload.FileSize <= maxThumbnailSource
+}
+
+// generatePreviews waits for a free previewSlots slot and then runs
+// generatePreviewsOnce.
+func (s *S3Client) generatePreviews(upload *Upload) error {
+	previewSlots <- struct{}{}
+	defer func() { <-previewSlots }()
+	return s.generatePreviewsOnce(upload)
+}
+
+// generatePreviewsOnce runs makePreviews for upload unless its previews were
+// made in the meantime, joining a run already under way for the same upload.
+// The caller holds a previewSlots slot, so runs it joins are never queued.
+func (s *S3Client) generatePreviewsOnce(upload *Upload) error {
+	done, err, _ := previewGeneration.Do(strconv.FormatUint(uint64(upload.ID), 10), func() (any, error) {
+		var current Upload
+		if err := DB.Select("id", "thumbnail_key", "storyboard_key").First(&current, upload.ID).Error; err != nil {
+			return nil, err
+		}
+		if current.ThumbnailKey != "" {
+			return current, nil
+		}
+		current = *upload
+		if err := s.makePreviews(&current); err != nil {
+			return nil, err
+		}
+		return current, nil
+	})
+	if err != nil {
+		return err
+	}
+	upload.ThumbnailKey = done.(Upload).ThumbnailKey
+	upload.StoryboardKey = done.(Upload).StoryboardKey
+	return nil
+}
+
+// makePreviews stores a thumbnail of an image or video upload and, for
+// videos, a storyboard, and records their keys on the upload. Video
+// thumbnails are poster frames taken a tenth of the way in, past the fades
+// and black frames most videos start with.
+func (s *S3Client) makePreviews(upload *Upload) error {
+	start := time.Now()
+
+	var thumb image.Image
+	var storyboard []byte
+	var err error
+	if isVideoFile(upload.Filename) {
+		thumb, storyboard, err = s.videoPreviews(upload)
+	} else {
+		thumb, err = s.imagePreview(upload)
+	}
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	thumb = imaging.Fill(thumb, thumbnailSize, thumbnailSize, imaging.Center, imaging.Lanczos)
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		return fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	keys := map[string]any{"thumbnail_key": thumbnailKey(upload.FileKey)}
+	if err := s.putObject(thumbnailKey(upload.FileKey), buf.Bytes(), "image/jpeg"); err != nil {
+		return err
+	}
+	if storyboard != nil {
+		keys["storyboard_key"] = storyboardKey(upload.FileKey)
+		if err := s.putObject(storyboardKey(upload.FileKey), storyboard, "image/jpeg"); err != nil {
+			return err
+		}
+	}
+
+	result := DB.Model(&Upload{}).Where("id = ?", upload.ID).Updates(keys)
+	if result.Error != nil {
+		return fmt.Errorf("failed to record previews: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		// Removed by removeUploads while the previews were being made.
+		for _, key := range keys {
+			s.deleteObject(key.(string))
+		}
+		return fmt.Errorf("upload %d was removed", upload.ID)
+	}
+	upload.ThumbnailKey = thumbnailKey(upload.FileKey)
+	if storyboard != nil {
+		upload.StoryboardKey = storyboardKey(upload.FileKey)
+	}
+
+	appLogger.WithFields(logrus.Fields{
+		"upload_id":   upload.ID,
+		"storyboard":  storyboard != nil,
+		"duration_ms": time.Since(start).Milliseconds(),
+	}).Info("Previews generated")
+	return nil
+}
+
+// imagePreview decodes an image upload, turned upright. Its dimensions are
+// checked first, so an image that would take gigabytes once decoded is never
+// decoded.
+func (s *S3Client) imagePreview(upload *Upload) (image.Image, error) {
+	stream, err := s.getFileStream(upload.FileKey)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	data, err := io.ReadAll(io.LimitReader(stream, maxThumbnailSource))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+		return nil, fmt.Errorf("image is too large to thumbnail: %dx%d", config.Width, config.Height)
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return img, nil
+}
+
+// videoPreviews returns a poster frame and a storyboard of a video upload. The
+// video is copied to a temporary file first, as ffmpeg has to seek in it.
+func (s *S3Client) videoPreviews(upload *Upload) (image.Image, []byte, error) {
+	dir, err := os.MkdirTemp("", "supashare-preview-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input"+strings.ToLower(filepath.Ext(upload.Filename)))
+	if err := s.downloadObject(upload.FileKey, input); err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+	defer cancel()
+
+	duration, err := videoDuration(ctx, input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var poster bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-ss", strconv.FormatFloat(duration/10, 'f', 3, 64),
+		"-i", input,
+		"-frames:v", "1",
+		"-f", "image2pipe",
+		"-c:v", "png",
+		"pipe:1",
+	)
+	cmd.Stdout = &poster
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, nil, fmt.Errorf("ffmpeg failed to take poster frame: %w", err)
+	}
+	frame, err := imaging.Decode(&poster)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode poster frame: %w", err)
+	}
+
+	// Frames are sampled at the rate that spreads the tiles over the whole
+	// video; tiles past the end of very short videos stay black.
+	rate := "1"
+	if duration > 0 {
+		rate = strconv.FormatFloat(storyboardColumns*storyboardRows/duration, 'f', 6, 64)
+	}
+	output := filepath.Join(dir, "storyboard.jpg")
+	cmd = exec.CommandContext(ctx, "ffmpeg",
+		"-i", input,
+		"-vf", fmt.Sprintf("fps=%s,scale=%d:-2,tile=%dx%d", rate, storyboardTileWidth, storyboardColumns, storyboardRows),
+		"-frames:v", "1",
+		"-q:v", "5",
+		"-y", output,
+	)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, nil, fmt.Errorf("ffmpeg failed to make storyboard: %w", err)
+	}
+	storyboard, err := os.ReadFile(output)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return frame, storyboard, nil
+}
+
+// videoDuration returns the length of the video at path in seconds, or 0 when
+// its container doesn't say.
+func videoDuration(ctx context.Context, path string) (float64, error) {
+	out, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed: %w", err)
+	}
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, nil // "N/A"
+	}
+	return duration, nil
+}
+
+// thumbnail returns the JPEG thumbnail of upload. Images uploaded before
+// thumbnails were stored, or whose thumbnail failed, get theirs on first use:
+// right away if a preview slot is free, otherwise queued in the background
+// with errPreviewPending returned, so requests never wait in line.
+func (s *S3Client) thumbnail(upload *Upload) ([]byte, error) {
+	if upload.ThumbnailKey == "" {
+		if !isImageFile(upload.Filename) || !canThumbnail(*upload) {
+			return nil, fmt.Errorf("no thumbnail for %s", upload.Filename)
+		}
+		select {
+		case previewSlots <- struct{}{}:
+			err := s.generatePreviewsOnce(upload)
+			<-previewSlots
+			if err != nil {
+				return nil, err
+			}
+		default:
+			queued := *upload
+			go func() {
+				if err := s.generatePreviews(&queued); err != nil {
+					appLogger.WithError(err).WithField("upload_id", queued.ID).Warn("failed to generate previews")
+				}
+			}()
+			return nil, errPreviewPending
+		}
+	}
+	return s.readObject(upload.ThumbnailKey)
+}
+
+// sendPreview answers with the thumbnail of upload, or its storyboard, and
+// with 404 when it has none (yet).
+func (s *S3Client) sendPreview(ctx *fiber.Ctx, upload *Upload, storyboard bool) error {
+	var data []byte
+	var err error
+	switch {
+	case storyboard && upload.StoryboardKey != "":
+		data, err = s.readObject(upload.StoryboardKey)
+	case !storyboard && upload.ThumbnailKey == "" && isVideoFile(upload.Filename):
+		// Still being generated, or ffmpeg couldn't read the video.
+		return ctx.SendStatus(fiber.StatusNotFound)
+	case !storyboard && canThumbnail(*upload):
+		data, err = s.thumbnail(upload)
+	default:
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+	if errors.Is(err, errPreviewPending) {
+		ctx.Set(fiber.HeaderCacheControl, "no-store")
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+	if err != nil {
+		logWithFields(ctx, logrus.Fields{"upload_id": upload.ID, "error": err.Error()}).Warn("Error loading preview")
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	ctx.Set(fiber.HeaderContentType, "image/jpeg")
+	return ctx.Send(data)
+}
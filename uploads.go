@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	UploadStatusPending   = "pending"
+	UploadStatusCommitted = "committed"
+)
+
+// maxReserveAttempts bounds how often a new object key or share link is tried
+// after a unique violation.
+const maxReserveAttempts = 5
+
+// pendingCleanupLockKey is the pg_try_advisory_lock key for the pending upload
+// cleanup, so only one replica runs it at a time.
+const pendingCleanupLockKey = 0x5375706170656e64 // "Supapend"
+
+// storeUpload stores an object and its Upload row without leaving either behind
+// on failure. A pending row and its first share link are inserted first to
+// reserve the link and object key, then put writes the object under
+// upload.FileKey, and finally the row is marked committed. If putting fails the
+// row is removed; if committing fails the object is removed too. Anything a
+// crash leaves pending is cleaned up by cleanupPendingUploads, which may also
+// have removed the row of a put that went quiet for too long; committing then
+// finds no pending row and fails.
+func (s *S3Client) storeUpload(upload *Upload, opts UploadOptions, put func(objectKey string) error) error {
+	if err := reserveUpload(upload, opts); err != nil {
+		return err
+	}
+
+	if err := put(upload.FileKey); err != nil {
+		if delErr := DB.Unscoped().Delete(upload).Error; delErr != nil {
+			appLogger.WithError(delErr).WithField("upload_id", upload.ID).Warn("failed to remove pending upload row")
+		}
+		return fmt.Errorf("error uploading file: %w", err)
+	}
+
+	// put may only learn the size and checksum while writing the object, so
+	// they are saved together with the status.
+	result := DB.Model(upload).Where("status = ?", UploadStatusPending).Updates(map[string]any{
+		"status":    UploadStatusCommitted,
+		"file_size": upload.FileSize,
+		"checksum":  upload.Checksum,
+	})
+	err := result.Error
+	if err == nil && result.RowsAffected != 1 {
+		err = errors.New("pending upload row is gone")
+	}
+	if err != nil {
+		if delErr := s.deleteObject(upload.FileKey); delErr == nil {
+			DB.Unscoped().Delete(upload)
+		}
+		return fmt.Errorf("error committing upload record: %w", err)
+	}
+	upload.Status = UploadStatusCommitted
+
+	// Archives are indexed right away so their contents page opens quickly;
+	// if this fails the first view indexes them instead.
+	if archiveFormatOf(upload.Filename) != "" {
+		indexed := *upload
+		go func() {
+			if err := s.indexArchive(&indexed); err != nil {
+				appLogger.WithError(err).WithField("upload_id", indexed.ID).Warn("failed to index archive")
+			}
+		}()
+	}
+
+	// Thumbnails are generated in the background too, a few at a time. Image
+	// thumbnails that fail are retried on first view; videos just go without.
+	if canThumbnail(*upload) {
+		previewed := *upload
+		go func() {
+			if err := s.generatePreviews(&previewed); err != nil {
+				appLogger.WithError(err).WithField("upload_id", previewed.ID).Warn("failed to generate previews")
+			}
+		}()
+	}
+
+	return nil
+}
+
+// removeUploads deletes uploads for good, along with their objects and
+// previews, to undo a batch that failed partway. Previews are deleted by the
+// keys they would have, as they may still be being generated. Uploads whose
+// object can't be deleted are soft-deleted instead, so purge retries them.
+func (s *S3Client) removeUploads(uploads []Upload) {
+	for i := range uploads {
+		upload := &uploads[i]
+		if err := s.deleteObject(upload.FileKey); err != nil {
+			appLogger.WithError(err).WithField("upload_id", upload.ID).Warn("failed to remove object of rolled back upload")
+			DB.Delete(upload)
+			continue
+		}
+		for _, key := range []string{thumbnailKey(upload.FileKey), storyboardKey(upload.FileKey)} {
+			s.deleteObject(key)
+		}
+		if err := DB.Unscoped().Delete(upload).Error; err != nil {
+			appLogger.WithError(err).WithField("upload_id", upload.ID).Warn("failed to remove rolled back upload")
+		}
+	}
+}
+
+// reserveUpload inserts upload as a pending row, generating a fresh object key
+// whenever the insert hits a unique violation on it, and then creates the
+// upload's first share link with the policy in opts.
+func reserveUpload(upload *Upload, opts UploadOptions) error {
+	upload.Status = UploadStatusPending
+	filename := upload.FileKey
+
+	share, err := newShare(0, opts)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		upload.ID = 0
+		err = DB.Omit("Shares").Create(upload).Error
+		if err == nil {
+			break
+		}
+
+		constraint, ok := uniqueViolation(err)
+		if !ok {
+			return fmt.Errorf("error saving upload record: %w", err)
+		}
+		if attempt == maxReserveAttempts {
+			return fmt.Errorf("error saving upload record after %d attempts: %w", maxReserveAttempts, err)
+		}
+
+		appLogger.WithFields(logrus.Fields{
+			"constraint": constraint,
+			"attempt":    attempt,
+		}).Warn("unique violation reserving upload, retrying")
+
+		if constraint == "idx_uploads_file_key" {
+			upload.FileKey = fmt.Sprintf("%d_%s", time.Now().UnixNano(), filename)
+		}
+	}
+
+	share.UploadID = upload.ID
+	if err := createShare(share, opts.ShareIDStyle); err != nil {
+		DB.Unscoped().Delete(upload)
+		return err
+	}
+	upload.Shares = []Share{*share}
+
+	return nil
+}
+
+// uniqueViolation reports whether err is a Postgres unique violation and, if so,
+// which constraint was violated.
+func uniqueViolation(err error) (string, bool) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return pgErr.ConstraintName, true
+	}
+	return "", false
+}
+
+// committedUploads scopes a query to uploads whose object was stored successfully.
+func committedUploads(db *gorm.DB) *gorm.DB {
+	return db.Where("status = ?", UploadStatusCommitted)
+}
+
+// touchUpload records that a pending upload is still being written, so
+// cleanupPendingUploads leaves it alone however long it takes in total.
+func touchUpload(uploadID uint) {
+	err := DB.Model(&Upload{}).
+		Where("id = ? AND status = ?", uploadID, UploadStatusPending).
+		Update("last_active_at", time.Now()).Error
+	if err != nil {
+		appLogger.WithError(err).WithField("upload_id", uploadID).Warn("failed to refresh pending upload")
+	}
+}
+
+// cleanupPendingUploads removes uploads that stayed pending without any
+// progress for longer than olderThan, along with any object they managed to
+// store, and aborts the multipart uploads they left unfinished.
+func cleanupPendingUploads(s3Client *S3Client, olderThan time.Duration) (int, error) {
+	var uploads []Upload
+	if err := DB.Unscoped().
+		Where("status = ? AND COALESCE(last_active_at, uploaded_at) < ?", UploadStatusPending, time.Now().Add(-olderThan)).
+		Find(&uploads).Error; err != nil {
+		return 0, fmt.Errorf("failed to query pending uploads: %w", err)
+	}
+
+	cleaned := 0
+	for _, upload := range uploads {
+		if _, exists, err := s3Client.headObject(upload.FileKey); err != nil {
+			appLogger.WithError(err).WithField("file_key", upload.FileKey).Warn("failed to check pending upload object")
+			continue
+		} else if exists {
+			if err := s3Client.deleteObject(upload.FileKey); err != nil {
+				continue
+			}
+		}
+
+		if err := DB.Unscoped().Delete(&upload).Error; err != nil {
+			appLogger.WithError(err).WithField("upload_id", upload.ID).Warn("failed to delete pending upload row")
+			continue
+		}
+		cleaned++
+	}
+
+	aborted, err := s3Client.abortStaleMultipartUploads(olderThan)
+	if len(uploads) > 0 || aborted > 0 {
+		appLogger.WithFields(logrus.Fields{
+			"found":   len(uploads),
+			"cleaned": cleaned,
+			"aborted": aborted,
+		}).Info("Cleaned up pending uploads")
+	}
+	return cleaned, err
+}
+
+// startPendingCleanup periodically removes uploads that never committed, e.g.
+// because the server died between storing the object and marking the row.
+func startPendingCleanup(s3Client *S3Client) {
+	ttl := time.Hour
+	if d, err := time.ParseDuration(os.Getenv("PENDING_UPLOAD_TTL")); err == nil && d > 0 {
+		ttl = d
+	}
+
+	go func() {
+		ticker := time.NewTicker(ttl / 2)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			err := runExclusive(pendingCleanupLockKey, func() error {
+				_, err := cleanupPendingUploads(s3Client, ttl)
+				return err
+			})
+			if err != nil {
+				appLogger.WithError(err).Error("Pending upload cleanup failed")
+			}
+		}
+	}()
+}
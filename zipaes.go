@@ -0,0 +1,173 @@
+package main
+
+import (
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// WinZip AES encryption (AE-1) as read by 7-Zip, WinZip and most unzip tools.
+// Entries are stored with method 99 and an extra field naming the real
+// compression method. The entry data is a random salt, a two byte password
+// verifier, the compressed data encrypted with AES-256 in little-endian
+// counter mode, and a truncated HMAC-SHA1 of the encrypted data.
+const (
+	winzipAESMethod     = 99
+	winzipAESExtraID    = 0x9901
+	winzipAESStrength   = 3 // AES-256
+	winzipAESKeySize    = 32
+	winzipAESSaltSize   = 16
+	winzipAESIterations = 1000
+	winzipAESMACSize    = 10
+)
+
+// winzipAESExtra is the extra field of an encrypted entry whose data is
+// compressed with method.
+func winzipAESExtra(method uint16) []byte {
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], winzipAESExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], 1) // AE-1: the CRC is kept
+	copy(extra[6:], "AE")
+	extra[8] = winzipAESStrength
+	binary.LittleEndian.PutUint16(extra[9:], method)
+	return extra
+}
+
+// newWinzipAESWriter starts an encrypted entry on out and returns the writer
+// for its uncompressed data, which is compressed with method at level first.
+// Each entry gets its own salt and therefore its own keys.
+func newWinzipAESWriter(out io.Writer, password string, method uint16, level int) (io.WriteCloser, error) {
+	salt := make([]byte, winzipAESSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	keys, err := pbkdf2.Key(sha1.New, password, salt, winzipAESIterations, 2*winzipAESKeySize+2)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(keys[:winzipAESKeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	// archive/zip creates the compressor before writing the local header, so
+	// the salt and verifier are held back until the first write.
+	enc := &winzipAESEncrypter{
+		out:    out,
+		prefix: append(salt, keys[2*winzipAESKeySize:]...),
+		stream: &winzipCTR{block: block, used: aes.BlockSize},
+		mac:    hmac.New(sha1.New, keys[winzipAESKeySize:2*winzipAESKeySize]),
+	}
+
+	w := &winzipAESWriter{enc: enc}
+	switch method {
+	case 0:
+		w.data = enc
+	case 8:
+		fw, err := flate.NewWriter(enc, level)
+		if err != nil {
+			return nil, err
+		}
+		w.data, w.compressor = fw, fw
+	default:
+		return nil, fmt.Errorf("unsupported compression method %d for encrypted entry", method)
+	}
+	return w, nil
+}
+
+type winzipAESWriter struct {
+	enc        *winzipAESEncrypter
+	data       io.Writer
+	compressor io.Closer
+}
+
+func (w *winzipAESWriter) Write(p []byte) (int, error) {
+	return w.data.Write(p)
+}
+
+// Close flushes the compressor and appends the authentication code.
+func (w *winzipAESWriter) Close() error {
+	if w.compressor != nil {
+		if err := w.compressor.Close(); err != nil {
+			return err
+		}
+	}
+	if err := w.enc.writePrefix(); err != nil {
+		return err
+	}
+	_, err := w.enc.out.Write(w.enc.mac.Sum(nil)[:winzipAESMACSize])
+	return err
+}
+
+// winzipAESEncrypter encrypts everything written to it onto out, after the
+// unencrypted prefix, feeding the ciphertext to mac.
+type winzipAESEncrypter struct {
+	out    io.Writer
+	prefix []byte
+	stream cipher.Stream
+	mac    hash.Hash
+	buf    []byte
+}
+
+func (e *winzipAESEncrypter) writePrefix() error {
+	if e.prefix == nil {
+		return nil
+	}
+	_, err := e.out.Write(e.prefix)
+	e.prefix = nil
+	return err
+}
+
+func (e *winzipAESEncrypter) Write(p []byte) (int, error) {
+	if err := e.writePrefix(); err != nil {
+		return 0, err
+	}
+	if cap(e.buf) < len(p) {
+		e.buf = make([]byte, len(p))
+	}
+	buf := e.buf[:len(p)]
+	e.stream.XORKeyStream(buf, p)
+	e.mac.Write(buf)
+	return e.out.Write(buf)
+}
+
+// winzipCTR is AES counter mode as WinZip does it: the counter block is a
+// little-endian integer starting at 1, which crypto/cipher's big-endian CTR
+// can't produce.
+type winzipCTR struct {
+	block     cipher.Block
+	counter   [aes.BlockSize]byte
+	keystream [aes.BlockSize]byte
+	used      int
+}
+
+func (c *winzipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == aes.BlockSize {
+			c.next()
+		}
+		dst[i] = src[i] ^ c.keystream[c.used]
+		c.used++
+	}
+}
+
+func (c *winzipCTR) next() {
+	for i := range c.counter {
+		c.counter[i]++
+		if c.counter[i] != 0 {
+			break
+		}
+	}
+	c.block.Encrypt(c.keystream[:], c.counter[:])
+	c.used = 0
+}